@@ -0,0 +1,118 @@
+package riak
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// A circuitBreaker stops requests to a node or cluster after consecutive
+// failures. Once open, requests fail right away until the cooldown is over;
+// the breaker then turns half-open and lets a single probe through, closing
+// again if it succeeds. Shared by the committers.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	// Called on state changes, outside of the lock
+	onChange func(name string, from breakerState, to breakerState)
+	now      func() time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration,
+	onChange func(string, breakerState, breakerState)) *circuitBreaker {
+
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+		now:       time.Now,
+	}
+}
+
+// Whether a request may go through. probe is true for the single request
+// let through once the cooldown is over, which should be a health check.
+func (b *circuitBreaker) Allow() (allowed bool, probe bool) {
+	b.lock.Lock()
+	switch b.state {
+	case breakerClosed:
+		b.lock.Unlock()
+		return true, false
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) >= b.cooldown {
+			b.setState(breakerHalfOpen)
+			return true, true
+		}
+	}
+	b.lock.Unlock()
+	return false, false
+}
+
+// Time left before an open breaker lets a probe through
+func (b *circuitBreaker) Remaining() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	if remaining := b.cooldown - b.now().Sub(b.openedAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Records a successful request, closing the breaker
+func (b *circuitBreaker) Success() {
+	b.lock.Lock()
+	b.failures = 0
+	if b.state == breakerClosed {
+		b.lock.Unlock()
+		return
+	}
+	b.setState(breakerClosed)
+}
+
+// Records a failed request, opening the breaker after too many in a row or
+// when a probe fails
+func (b *circuitBreaker) Failure() {
+	b.lock.Lock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+		return
+	}
+	b.lock.Unlock()
+}
+
+// Changes the state then releases the lock before calling onChange
+func (b *circuitBreaker) setState(state breakerState) {
+	from := b.state
+	b.state = state
+	b.lock.Unlock()
+	if b.onChange != nil {
+		b.onChange(b.name, from, state)
+	}
+}
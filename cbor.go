@@ -0,0 +1,305 @@
+package riak
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"math"
+)
+
+// CBOR formatter encodes the same fields as the clean formatter, as a CBOR
+// map (RFC 7049)
+type CborMessageFormatter struct {
+	clean *CleanMessageFormatter
+}
+
+func NewCborMessageFormatter(clean *CleanMessageFormatter) *CborMessageFormatter {
+	return &CborMessageFormatter{clean: clean}
+}
+
+func (f *CborMessageFormatter) Format(m *message.Message) (doc []byte, err error) {
+	return f.clean.encode(m, func(b *bytes.Buffer, d document) {
+		writeCbor(b, d)
+	})
+}
+
+func (f *CborMessageFormatter) ContentType() string {
+	return "application/cbor"
+}
+
+// CBOR major types
+const (
+	cborUnsigned byte = iota << 5
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+func writeCbor(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteByte(cborSimple | 22)
+	case bool:
+		if v {
+			b.WriteByte(cborSimple | 21)
+		} else {
+			b.WriteByte(cborSimple | 20)
+		}
+	case int64:
+		if v >= 0 {
+			writeCborHeader(b, cborUnsigned, uint64(v))
+		} else {
+			writeCborHeader(b, cborNegative, uint64(-(v + 1)))
+		}
+	case float64:
+		b.WriteByte(cborSimple | 27)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case string:
+		writeCborHeader(b, cborText, uint64(len(v)))
+		b.WriteString(v)
+	case []byte:
+		writeCborHeader(b, cborBytes, uint64(len(v)))
+		b.Write(v)
+	case rawValue:
+		writeCbor(b, v.decode())
+	case []interface{}:
+		writeCborHeader(b, cborArray, uint64(len(v)))
+		for _, item := range v {
+			writeCbor(b, item)
+		}
+	case document:
+		writeCborHeader(b, cborMap, uint64(len(v)))
+		for _, field := range v {
+			writeCbor(b, field.name)
+			writeCbor(b, field.value)
+		}
+	case map[string]interface{}:
+		writeCborHeader(b, cborMap, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			writeCbor(b, k)
+			writeCbor(b, v[k])
+		}
+	default:
+		writeCbor(b, fmt.Sprint(v))
+	}
+}
+
+// Writes a major type with its argument in the smallest encoding holding it
+func writeCborHeader(b *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		b.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		b.WriteByte(major | 24)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		b.WriteByte(major | 25)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		b.WriteByte(major | 26)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	default:
+		b.WriteByte(major | 27)
+		binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+// Decodes a CBOR value, as written by the cbor format. Maps are decoded to
+// map[string]interface{}, arrays to []interface{}, integers to int64 (uint64
+// above math.MaxInt64) and floats to float64. Tags are skipped and
+// indefinite length items are supported.
+func DecodeCbor(data []byte) (value interface{}, err error) {
+	d := &cborDecoder{byteReader{data: data}}
+	if value, err = d.decode(); err == nil {
+		if _, ok := value.(cborBreak); ok {
+			value, err = nil, errUnexpectedBreak
+		} else if d.pos != len(data) {
+			err = fmt.Errorf("%d trailing bytes after CBOR value", len(data)-d.pos)
+		}
+	}
+	return
+}
+
+type cborDecoder struct {
+	byteReader
+}
+
+// Marks the end of an indefinite length item
+type cborBreak struct{}
+
+var errUnexpectedBreak = errors.New("unexpected CBOR break")
+
+// Indefinite length marker returned by argument
+const cborIndefinite = math.MaxUint64
+
+// Reads the argument following the initial byte of an item
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return d.uint(1 << (info - 24))
+	case info == 31:
+		return cborIndefinite, nil
+	}
+	return 0, fmt.Errorf("invalid CBOR additional information %d", info)
+}
+
+func (d *cborDecoder) decode() (interface{}, error) {
+	p, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := p[0]&0xe0, p[0]&0x1f
+	if major == cborSimple {
+		return d.simple(info)
+	}
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("CBOR negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		s, err := d.str(major, n)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(s), nil
+		}
+		return s, nil
+	case cborArray:
+		a := []interface{}{}
+		for i := uint64(0); n == cborIndefinite || i < n; i++ {
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(cborBreak); ok {
+				if n != cborIndefinite {
+					return nil, errUnexpectedBreak
+				}
+				break
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case cborMap:
+		m := map[string]interface{}{}
+		for i := uint64(0); n == cborIndefinite || i < n; i++ {
+			k, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := k.(cborBreak); ok {
+				if n != cborIndefinite {
+					return nil, errUnexpectedBreak
+				}
+				break
+			}
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	}
+	// Tagged item
+	return d.decode()
+}
+
+// Reads a byte or text string, joining the chunks of indefinite length ones
+func (d *cborDecoder) str(major byte, n uint64) ([]byte, error) {
+	if n != cborIndefinite {
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errTruncated
+		}
+		p, err := d.next(int(n))
+		return append([]byte(nil), p...), err
+	}
+	var s []byte
+	for {
+		p, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		if p[0] == 0xff {
+			return s, nil
+		}
+		if p[0]&0xe0 != major {
+			return nil, fmt.Errorf("invalid chunk in indefinite length CBOR string")
+		}
+		size, err := d.argument(p[0] & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := d.str(major, size)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+func (d *cborDecoder) simple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		v, err := d.uint(2)
+		return halfToFloat(uint16(v)), err
+	case 26:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 27:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 31:
+		return cborBreak{}, nil
+	}
+	return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+}
+
+// Converts an IEEE 754 half precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package riak
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Returned while the breaker of the cluster is open
+var errClusterOpen = errors.New("Circuit breaker of the cluster is open")
+
+// What happens to batches while the breaker of the cluster is open
+const (
+	breakerFail  = "fail"
+	breakerSpool = "spool"
+)
+
+// A StatusError is an error response of Riak
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Store response in error: %s", e.Status)
+}
+
+// Whether an error is the fault of the node rather than of the object: any
+// error but a client error response
+func nodeFailure(err error) bool {
+	if statusErr, ok := err.(*StatusError); ok {
+		return statusErr.Code >= 500
+	}
+	return true
+}
+
+// Checks the health of the node
+func (h *HttpBulkIndexer) Ping() error {
+	client := &http.Client{Timeout: time.Duration(h.HTTPTimeout) * time.Millisecond}
+	response, err := client.Get(fmt.Sprintf("%s://%s/ping", h.Protocol, h.Domain))
+	if err != nil {
+		return fmt.Errorf("Unable to ping %s: %s", h.Domain, err)
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Ping of %s in error: %s", h.Domain, response.Status)
+	}
+	return nil
+}
+
+// A clusterIndexer stores objects on the nodes of a cluster, failing over
+// from a node to the next when it fails. Each node has a circuit breaker, so
+// that failing nodes are skipped, and so has the cluster, failing batches
+// right away while no node works. Each committer has its own clusterIndexer,
+// with its own connections, while the breakers are shared.
+type clusterIndexer struct {
+	nodes    []*HttpBulkIndexer
+	breakers []*circuitBreaker
+	cluster  *circuitBreaker
+	// Shared by the committers
+	stats     *riakStats
+	nodeStats []*nodeStats
+	latencies *sampleWindow
+	// Node objects are stored on, as long as it works
+	next int
+}
+
+func (c *clusterIndexer) CheckFlush(count int, length int) bool {
+	return c.nodes[0].CheckFlush(count, length)
+}
+
+func (c *clusterIndexer) Index(objects []*RiakObject) (success bool, err error) {
+	allowed, probe := c.cluster.Allow()
+	if !allowed {
+		return false, errClusterOpen
+	}
+	if probe {
+		if c.ping() != nil {
+			// Still down, the batch goes wherever batches go while it's open
+			c.cluster.Failure()
+			return false, errClusterOpen
+		}
+		c.cluster.Success()
+	}
+	var rejected error
+	for i, obj := range objects {
+		if err = c.store(obj); err != nil && nodeFailure(err) {
+			// No node works, the rest of the batch fails along with the object
+			atomic.AddInt64(&c.stats.failed, int64(len(objects)-i))
+			c.cluster.Failure()
+			return false, err
+		}
+		if err != nil {
+			// Rejected by a working node, the rest of the batch still goes
+			atomic.AddInt64(&c.stats.failed, 1)
+			rejected = err
+			continue
+		}
+		atomic.AddInt64(&c.stats.written, 1)
+	}
+	c.cluster.Success()
+	return rejected == nil, rejected
+}
+
+// Stores an object on the first node which works, starting from the last one
+func (c *clusterIndexer) store(obj *RiakObject) (err error) {
+	retry := false
+	for i := range c.nodes {
+		n := (c.next + i) % len(c.nodes)
+		node, breaker := c.nodes[n], c.breakers[n]
+		allowed, probe := breaker.Allow()
+		if !allowed {
+			continue
+		}
+		if probe {
+			if err = node.Ping(); err != nil {
+				breaker.Failure()
+				retry = true
+				continue
+			}
+			breaker.Success()
+		}
+		if retry {
+			atomic.AddInt64(&c.stats.retried, 1)
+		}
+		start := time.Now()
+		err = node.store(obj)
+		latency := time.Since(start)
+		c.nodeStats[n].observe(latency, err != nil)
+		c.latencies.Add(int64(latency))
+		if err != nil && nodeFailure(err) {
+			breaker.Failure()
+			retry = true
+			continue
+		}
+		// Stored, or rejected by a working node
+		breaker.Success()
+		c.next = n
+		return err
+	}
+	if err == nil {
+		err = fmt.Errorf("No node of the cluster is available")
+	}
+	return err
+}
+
+// Pings the nodes until one answers
+func (c *clusterIndexer) ping() (err error) {
+	for _, node := range c.nodes {
+		if err = node.Ping(); err == nil {
+			return nil
+		}
+	}
+	return
+}
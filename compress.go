@@ -0,0 +1,99 @@
+package riak
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"strings"
+)
+
+// User metadata holding the compression algorithm of compressed objects
+const metaCompression = "compression"
+
+// A compressor compresses the values of objects of at least minSize bytes
+// with gzip, snappy or zstd. The algorithm is recorded in the user metadata
+// of the objects, and as their Content-Encoding for gzip and zstd so that
+// HTTP readers can decode them transparently.
+type compressor struct {
+	algorithm string
+	minSize   int
+	zstd      *zstd.Encoder
+}
+
+func newCompressor(algorithm string, minSize int) (c *compressor, err error) {
+	c = &compressor{algorithm: strings.ToLower(algorithm), minSize: minSize}
+	switch c.algorithm {
+	case "gzip", "snappy":
+	case "zstd":
+		if c.zstd, err = zstd.NewWriter(nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown compression: %s", algorithm)
+	}
+	return
+}
+
+// Replaces the value of the object with its compression, unless it is too
+// small to be worth it.
+func (c *compressor) Compress(obj *RiakObject) error {
+	if len(obj.Value) < c.minSize {
+		return nil
+	}
+	switch c.algorithm {
+	case "gzip":
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(obj.Value); err != nil {
+			return fmt.Errorf("Unable to compress value: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("Unable to compress value: %s", err)
+		}
+		obj.Value = buf.Bytes()
+		obj.ContentEncoding = "gzip"
+	case "snappy":
+		obj.Value = snappy.Encode(nil, obj.Value)
+	case "zstd":
+		obj.Value = c.zstd.EncodeAll(obj.Value, nil)
+		obj.ContentEncoding = "zstd"
+	}
+	obj.SetMeta(metaCompression, c.algorithm)
+	return nil
+}
+
+// Decompresses the value of an object in place, as written by the
+// compression option. Objects which aren't compressed are left untouched.
+// Encrypted objects must be decrypted first.
+func Decompress(obj *RiakObject) (err error) {
+	var value []byte
+	switch obj.UserMeta[metaCompression] {
+	case "":
+		return nil
+	case "gzip":
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(obj.Value)); err == nil {
+			value, err = ioutil.ReadAll(r)
+		}
+	case "snappy":
+		value, err = snappy.Decode(nil, obj.Value)
+	case "zstd":
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(nil); err == nil {
+			value, err = d.DecodeAll(obj.Value, nil)
+			d.Close()
+		}
+	default:
+		return fmt.Errorf("Unsupported compression: %s", obj.UserMeta[metaCompression])
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to decompress value: %s", err)
+	}
+	obj.Value = value
+	obj.ContentEncoding = ""
+	delete(obj.UserMeta, metaCompression)
+	return nil
+}
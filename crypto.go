@@ -0,0 +1,136 @@
+package riak
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// User metadata of encrypted objects
+const (
+	metaEncryption  = "encryption"
+	metaKeyId       = "key-id"
+	metaContentType = "content-type"
+)
+
+const encryptionAESGCM = "aes-gcm"
+
+// Reads an AES key file, holding 16, 24 or 32 bytes hex encoded. Raw keys
+// aren't accepted, as one made only of hex digits would read as a shorter
+// key.
+func LoadKeyFile(path string) (key []byte, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return nil, fmt.Errorf("Unable to read key file %s: %s", path, err)
+	}
+	if key, err = hex.DecodeString(string(bytes.TrimSpace(data))); err != nil {
+		return nil, fmt.Errorf("Key file %s isn't hex encoded: %s", path, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Key file %s doesn't hold a 16, 24 or 32 bytes AES key", path)
+}
+
+// Returns the additional data a value is sealed with, binding it to the
+// location of the object and to the key ID, so that it can't be moved to
+// another object unnoticed
+func additionalData(obj *RiakObject, keyId string) []byte {
+	location := RiakObject{BucketType: obj.BucketType, Bucket: obj.Bucket, Key: obj.Key}
+	if len(location.BucketType) == 0 {
+		location.BucketType = "default"
+	}
+	return []byte(location.Path() + "\x00" + keyId)
+}
+
+// An envelopeCipher encrypts the values of objects with AES-GCM before they
+// are stored. The ID of the key is stored in the user metadata of the
+// objects so that keys can be rotated.
+type envelopeCipher struct {
+	keyId string
+	aead  cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newEnvelopeCipher(keyId string, key []byte) (c *envelopeCipher, err error) {
+	c = &envelopeCipher{keyId: keyId}
+	if c.aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Replaces the value of the object with its encryption, the random nonce
+// followed by the sealed value. The object must have its final location,
+// with a key, which the value is bound to. The original content type is kept
+// in the user metadata, and the Content-Encoding of compressed values is
+// dropped as it no longer applies.
+func (c *envelopeCipher) Seal(obj *RiakObject) error {
+	if len(obj.Key) == 0 {
+		return fmt.Errorf("Encrypted objects need a key")
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	obj.Value = c.aead.Seal(nonce, nonce, obj.Value, additionalData(obj, c.keyId))
+	obj.ContentEncoding = ""
+	obj.SetMeta(metaEncryption, encryptionAESGCM)
+	obj.SetMeta(metaKeyId, c.keyId)
+	obj.SetMeta(metaContentType, obj.ContentType)
+	obj.ContentType = "application/octet-stream"
+	return nil
+}
+
+// A KeyRing holds the AES keys, by key ID, used to decrypt objects written
+// with any of them.
+type KeyRing map[string][]byte
+
+// Decrypts the value of an object in place, restoring its content type.
+// The object must be at the location it was sealed for. Objects which
+// aren't encrypted are left untouched.
+func (k KeyRing) Open(obj *RiakObject) error {
+	switch obj.UserMeta[metaEncryption] {
+	case "":
+		return nil
+	case encryptionAESGCM:
+	default:
+		return fmt.Errorf("Unsupported encryption: %s", obj.UserMeta[metaEncryption])
+	}
+	keyId := obj.UserMeta[metaKeyId]
+	key, ok := k[keyId]
+	if !ok {
+		return fmt.Errorf("Unknown encryption key: %s", keyId)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(obj.Value) < aead.NonceSize() {
+		return fmt.Errorf("Encrypted value is too short")
+	}
+	nonce, sealed := obj.Value[:aead.NonceSize()], obj.Value[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, sealed, additionalData(obj, keyId))
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt value with key %s: %s", keyId, err)
+	}
+	obj.Value = value
+	obj.ContentType = obj.UserMeta[metaContentType]
+	delete(obj.UserMeta, metaEncryption)
+	delete(obj.UserMeta, metaKeyId)
+	delete(obj.UserMeta, metaContentType)
+	return nil
+}
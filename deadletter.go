@@ -0,0 +1,37 @@
+package riak
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"time"
+)
+
+// User metadata of dead letters
+const (
+	metaError     = "error"
+	metaTimestamp = "timestamp"
+	metaPlugin    = "plugin"
+)
+
+// Builds the dead letter of a message which couldn't be stored: the protobuf
+// encoded message, keyed by its UUID, with the error, the time of failure
+// and the plugin name as user metadata, so that it can be replayed.
+func (o *RiakOutput) deadLetter(msg *message.Message, reason error) (obj *RiakObject, err error) {
+	obj = &RiakObject{
+		BucketType:  o.deadLetterType,
+		Bucket:      o.deadLetterBucket,
+		Key:         msg.GetUuidString(),
+		ContentType: "application/x-protobuf",
+	}
+	if obj.Value, err = proto.Marshal(msg); err != nil {
+		return nil, fmt.Errorf("Unable to encode message: %s", err)
+	}
+	obj.SetMeta(metaError, reason.Error())
+	obj.SetMeta(metaTimestamp, time.Now().UTC().Format(time.RFC3339Nano))
+	obj.SetMeta(metaPlugin, o.pluginName)
+	if err = o.seal(obj); err != nil {
+		return nil, err
+	}
+	return
+}
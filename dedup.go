@@ -0,0 +1,62 @@
+package riak
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A uuidCache remembers the Uuids of the most recently written messages, so
+// that repeats of messages already stored are skipped without a round trip
+// to Riak. It is shared by the receiver and the committer.
+type uuidCache struct {
+	lock     sync.Mutex
+	capacity int
+	// Most recently written first
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newUuidCache(capacity int) *uuidCache {
+	return &uuidCache{
+		capacity: capacity,
+		order:    list.New(),
+		elements: make(map[string]*list.Element, capacity),
+	}
+}
+
+// Whether the Uuid was recently written
+func (c *uuidCache) Contains(uuid string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.elements[uuid]; ok {
+		c.order.MoveToFront(element)
+		return true
+	}
+	return false
+}
+
+// Records a written Uuid, evicting the least recently used one if full
+func (c *uuidCache) Add(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.elements[uuid]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.elements[uuid] = c.order.PushFront(uuid)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(string))
+	}
+}
+
+// Records the Uuids of written objects. Dead letters and objects keyed by
+// Riak have none.
+func (c *uuidCache) AddObjects(objects []*RiakObject) {
+	for _, obj := range objects {
+		if len(obj.Uuid) > 0 {
+			c.Add(obj.Uuid)
+		}
+	}
+}
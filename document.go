@@ -0,0 +1,198 @@
+package riak
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// A document is the ordered list of named values extracted from a message
+// by the clean formatter, before it is encoded to JSON, MessagePack or CBOR.
+//
+// Values are either nil, string, int64, float64, bool, []byte, rawValue,
+// []interface{} of values or a nested document.
+type document []documentField
+
+type documentField struct {
+	name  string
+	value interface{}
+}
+
+// Appends a named value to the document
+func (d *document) add(name string, value interface{}) {
+	*d = append(*d, documentField{name, value})
+}
+
+// Returns the position of the named value, or -1
+func (d document) index(name string) int {
+	for i, field := range d {
+		if field.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Inserts a value at the path of nested objects, creating the missing
+// ones. Returns false, leaving the document untouched, when the path
+// collides with an existing value and the collision rule can't resolve it.
+func (d *document) insert(path []string, value interface{}, collision int) bool {
+	i := d.index(path[0])
+	if i < 0 {
+		if len(path) > 1 {
+			sub := document{}
+			sub.insert(path[1:], value, collision)
+			value = sub
+		}
+		d.add(path[0], value)
+		return true
+	}
+
+	existing := (*d)[i].value
+	sub, isDocument := existing.(document)
+	if len(path) > 1 {
+		if !isDocument {
+			switch collision {
+			case collisionOverwrite:
+				sub = document{}
+			case collisionValueKey:
+				sub = document{{"_value", existing}}
+			default:
+				return false
+			}
+		}
+		if !sub.insert(path[1:], value, collision) {
+			return false
+		}
+		(*d)[i].value = sub
+		return true
+	}
+
+	switch {
+	case collision == collisionOverwrite:
+		(*d)[i].value = value
+	case collision == collisionValueKey && isDocument && sub.index("_value") < 0:
+		sub.add("_value", value)
+		(*d)[i].value = sub
+	default:
+		return false
+	}
+	return true
+}
+
+// A rawValue is a JSON fragment inserted into the document untouched (see
+// raw_bytes_fields)
+type rawValue []byte
+
+// Decodes a raw JSON fragment so it can be encoded in binary formats. Raw
+// values which are not valid JSON are kept as bytes.
+func (r rawValue) decode() interface{} {
+	v, err := parseJSON(r)
+	if err != nil {
+		return []byte(r)
+	}
+	return v
+}
+
+// Parses a JSON value, keeping the order of object keys: objects are parsed
+// to documents, arrays to []interface{} and numbers to int64 or float64.
+func parseJSON(data []byte) (value interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if value, err = parseJSONValue(decoder); err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+func parseJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			d := document{}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := parseJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				d.add(key.(string), value)
+			}
+			_, err = decoder.Token()
+			return d, err
+		}
+		a := []interface{}{}
+		for decoder.More() {
+			value, err := parseJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		_, err = decoder.Token()
+		return a, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+	return token, nil
+}
+
+// Writes the document as a JSON object
+func writeDocument(b *bytes.Buffer, d document) {
+	b.WriteString(`{`)
+	for i, field := range d {
+		if i > 0 {
+			b.WriteString(`,`)
+		}
+		writeQuotedString(b, field.name)
+		b.WriteString(`:`)
+		writeJSONValue(b, field.value)
+	}
+	b.WriteString(`}`)
+}
+
+func writeJSONValue(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		writeQuotedString(b, v)
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case []byte:
+		writeQuotedString(b, base64.StdEncoding.EncodeToString(v))
+	case rawValue:
+		b.Write(v)
+	case []interface{}:
+		b.WriteString(`[`)
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(`,`)
+			}
+			writeJSONValue(b, item)
+		}
+		b.WriteString(`]`)
+	case document:
+		writeDocument(b, v)
+	default:
+		b.WriteString(`null`)
+	}
+}
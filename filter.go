@@ -0,0 +1,68 @@
+package riak
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A fieldFilter selects dynamic fields by name. Patterns are globs, where
+// "*" matches any sequence of characters and "?" a single one, or regular
+// expressions when prefixed with "re:".
+type fieldFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newFieldFilter(include []string, exclude []string) (f *fieldFilter, err error) {
+	f = new(fieldFilter)
+	if f.include, err = compilePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func compilePatterns(patterns []string) (compiled []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		var re *regexp.Regexp
+		if strings.HasPrefix(pattern, "re:") {
+			re, err = regexp.Compile(pattern[3:])
+		} else {
+			re, err = regexp.Compile(globToRegexp(pattern))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid field pattern %s: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return
+}
+
+// Converts a glob pattern to an anchored regular expression
+func globToRegexp(glob string) string {
+	re := regexp.QuoteMeta(glob)
+	re = strings.Replace(re, `\*`, `.*`, -1)
+	re = strings.Replace(re, `\?`, `.`, -1)
+	return "^" + re + "$"
+}
+
+// Whether the field is included: it matches one of the include patterns, if
+// any, and none of the exclude patterns.
+func (f *fieldFilter) Match(name string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return false
+	}
+	return !matchAny(f.exclude, name)
+}
+
+func matchAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
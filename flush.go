@@ -0,0 +1,76 @@
+package riak
+
+import (
+	"sync"
+	"time"
+)
+
+// Weight of the last batch in the moving averages of the latency and errors
+const adaptiveWeight = 0.2
+
+// Error rate above which batches shrink
+const adaptiveMaxErrorRate = 0.1
+
+// An adaptiveFlush sizes batches out of the observed writes: it shrinks them
+// when writes fail or take longer than the target latency, and grows them
+// back while writes are well within it. It is shared by the receiver, which
+// reads the batch size, and the committers, which report their writes.
+type adaptiveFlush struct {
+	lock     sync.Mutex
+	minCount int
+	maxCount int
+	target   time.Duration
+	count    int
+	// Moving averages of the batch latency and error rate
+	latency   float64
+	errorRate float64
+}
+
+func newAdaptiveFlush(count int, minCount int, maxCount int, target time.Duration) *adaptiveFlush {
+	a := &adaptiveFlush{minCount: minCount, maxCount: maxCount, target: target, count: count}
+	a.count = a.clamp(count)
+	return a
+}
+
+func (a *adaptiveFlush) clamp(count int) int {
+	if count < a.minCount {
+		return a.minCount
+	}
+	if count > a.maxCount {
+		return a.maxCount
+	}
+	return count
+}
+
+// Current number of objects per batch
+func (a *adaptiveFlush) Count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.count
+}
+
+// Records how long a batch write took and whether it failed, and resizes
+// batches accordingly
+func (a *adaptiveFlush) Observe(latency time.Duration, failed bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.latency += adaptiveWeight * (float64(latency) - a.latency)
+	errors := 0.0
+	if failed {
+		errors = 1
+	}
+	a.errorRate += adaptiveWeight * (errors - a.errorRate)
+
+	switch {
+	case a.errorRate > adaptiveMaxErrorRate:
+		a.count = a.clamp(a.count / 2)
+	case a.latency > float64(a.target):
+		a.count = a.clamp(a.count * 3 / 4)
+	case a.latency < float64(a.target)/2:
+		growth := a.count / 10
+		if growth < 1 {
+			growth = 1
+		}
+		a.count = a.clamp(a.count + growth)
+	}
+}
@@ -0,0 +1,251 @@
+package riak
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A template is a bucket or key name with "%{...}" interpolations, compiled
+// once at Init. An interpolation is a message attribute (Type, Hostname,
+// Pid, UUID, Logger, EnvVersion or Severity), a dynamic field name or an
+// explicit time layout ("time:2006.01.02"), followed by "|" separated
+// filters (lower, upper, slug, hash, truncate:N) and at most one default
+// value, any segment which isn't a filter, used when the field is missing or
+// empty. For example: "%{Hostname|lower|unknown}".
+type template struct {
+	source string
+	parts  []templatePart
+}
+
+// A templatePart is either literal text or an interpolation
+type templatePart struct {
+	literal string
+	// Attribute, field name or time layout of interpolations
+	name       string
+	isVariable bool
+	isTime     bool
+	filters    []func(string) string
+	def        string
+	hasDefault bool
+}
+
+func compileTemplate(source string) (t *template, err error) {
+	t = &template{source: source}
+	rest := source
+	for len(rest) > 0 {
+		start := strings.Index(rest, "%{")
+		end := -1
+		if start > -1 {
+			end = strings.Index(rest[start:], "}")
+		}
+		if start < 0 || end < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:start]})
+		}
+		var part templatePart
+		if part, err = compileInterpolation(rest[start+2 : start+end]); err != nil {
+			return nil, fmt.Errorf("Invalid interpolation in %s: %s", source, err)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[start+end+1:]
+	}
+	return
+}
+
+func compileInterpolation(spec string) (part templatePart, err error) {
+	segments := strings.Split(spec, "|")
+	part.isVariable = true
+	part.name = segments[0]
+	if strings.HasPrefix(part.name, "time:") {
+		part.name = part.name[5:]
+		part.isTime = true
+	}
+	for _, segment := range segments[1:] {
+		var filter func(string) string
+		if filter, err = newFilter(segment); err != nil {
+			return
+		}
+		if filter != nil {
+			part.filters = append(part.filters, filter)
+		} else if part.hasDefault {
+			return part, fmt.Errorf("more than one default: %s and %s", part.def, segment)
+		} else {
+			part.def, part.hasDefault = segment, true
+		}
+	}
+	return
+}
+
+// Returns the named filter, or nil if the name isn't one of a filter
+func newFilter(name string) (filter func(string) string, err error) {
+	switch name {
+	case "lower":
+		return strings.ToLower, nil
+	case "upper":
+		return strings.ToUpper, nil
+	case "slug":
+		return slug, nil
+	case "hash":
+		return func(value string) string {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:])
+		}, nil
+	}
+	if strings.HasPrefix(name, "truncate:") {
+		n, err := strconv.Atoi(name[9:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid truncate length: %s", name[9:])
+		}
+		return func(value string) string {
+			if utf8.RuneCountInString(value) > n {
+				return string([]rune(value)[:n])
+			}
+			return value
+		}, nil
+	}
+	return nil, nil
+}
+
+// Lower cases the value, replacing runs of anything but ASCII letters and
+// digits with a dash
+func slug(value string) string {
+	var b []byte
+	dash := false
+	for _, c := range strings.ToLower(value) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && len(b) > 0 {
+				b = append(b, '-')
+			}
+			b = append(b, byte(c))
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return string(b)
+}
+
+// Whether the template renders to an empty string
+func (t *template) Empty() bool {
+	return t == nil || len(t.parts) == 0
+}
+
+// Renders the template for a message. An error along with the rendered
+// value means an interpolation fell back to a time layout without effect.
+func (t *template) Render(e *RiakCoordinates, m *message.Message) (rendered string, err error) {
+	if t == nil {
+		return
+	}
+	values := make([]string, len(t.parts))
+	for i := range t.parts {
+		part := &t.parts[i]
+		if !part.isVariable {
+			values[i] = part.literal
+			continue
+		}
+		var partErr error
+		if values[i], partErr = part.render(e, m); partErr != nil {
+			if e.MissingField == "error" {
+				return "", fmt.Errorf("%s to interpolate %s", partErr, t.source)
+			}
+			err = fmt.Errorf("Could not interpolate field from config: %s", t.source)
+		}
+	}
+	return strings.Join(values, ""), err
+}
+
+func (p *templatePart) render(e *RiakCoordinates, m *message.Message) (value string, err error) {
+	found := true
+	if p.isTime {
+		value = e.time().Format(p.name)
+	} else {
+		value, found = lookup(e, m, p.name)
+	}
+	if p.hasDefault && (!found || len(value) == 0) {
+		value, found = p.def, true
+	}
+	if !found {
+		switch e.MissingField {
+		case "empty":
+		case "error":
+			return "", fmt.Errorf("Field %s is missing", p.name)
+		default:
+			// Unknown names are time layouts
+			if value = e.time().Format(p.name); value == p.name {
+				err = fmt.Errorf("Field %s is missing", p.name)
+			}
+		}
+	}
+	for _, filter := range p.filters {
+		value = filter(value)
+	}
+	return
+}
+
+// Returns the value of a message attribute or field, and whether there is one
+func lookup(e *RiakCoordinates, m *message.Message, name string) (string, bool) {
+	switch name {
+	case "Type":
+		return m.GetType(), true
+	case "Hostname":
+		return m.GetHostname(), true
+	case "Pid":
+		return strconv.Itoa(int(m.GetPid())), true
+	case "UUID":
+		return m.GetUuidString(), true
+	case "Logger":
+		return m.GetLogger(), true
+	case "EnvVersion":
+		return m.GetEnvVersion(), true
+	case "Severity":
+		return strconv.Itoa(int(m.GetSeverity())), true
+	}
+	if value, ok := m.GetFieldValue(name); ok && value != nil {
+		return formatFieldValue(value, e.BytesEncoding), true
+	}
+	return "", false
+}
+
+// Formats the value of a dynamic field for interpolation
+func formatFieldValue(value interface{}, bytesEncoding string) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []byte:
+		if bytesEncoding == "base64" {
+			return base64.URLEncoding.EncodeToString(v)
+		}
+		return hex.EncodeToString(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Time of time layout interpolations: the message timestamp if configured
+// to, the current time otherwise
+func (e *RiakCoordinates) time() (t time.Time) {
+	if e.RiakIndexFromTimestamp && e.Timestamp != nil {
+		t = time.Unix(0, *e.Timestamp).UTC()
+	} else {
+		t = time.Now()
+	}
+	if e.Location != nil {
+		t = t.In(e.Location)
+	}
+	return
+}
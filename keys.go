@@ -0,0 +1,105 @@
+package riak
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"math/big"
+	"time"
+)
+
+// Key strategies, choosing how the keys of objects are generated
+const (
+	// The Id template, or a key generated by Riak if there is none
+	keyTemplate = "template"
+	// The message Uuid
+	keyUuid = "uuid"
+	// Time sortable keys, the message timestamp followed by its Uuid, so
+	// that a message written twice gets the same key
+	keyKsuid = "ksuid"
+	keyUlid  = "ulid"
+	// SHA-256 of the formatted document, before compression and encryption
+	keyHash = "hash"
+)
+
+func validKeyStrategy(strategy string) error {
+	switch strategy {
+	case keyTemplate, keyUuid, keyKsuid, keyUlid, keyHash:
+		return nil
+	}
+	return fmt.Errorf("Unsupported key_strategy: %s", strategy)
+}
+
+// Returns the key of a message formatted to document, for the strategies
+// other than "template"
+func generateKey(strategy string, m *message.Message, document []byte) string {
+	switch strategy {
+	case keyUuid:
+		return m.GetUuidString()
+	case keyKsuid:
+		return ksuid(messageTime(m), m.GetUuid())
+	case keyUlid:
+		return ulid(messageTime(m), m.GetUuid())
+	case keyHash:
+		sum := sha256.Sum256(document)
+		return hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+func messageTime(m *message.Message) time.Time {
+	if m.Timestamp == nil {
+		return time.Now()
+	}
+	return time.Unix(0, m.GetTimestamp())
+}
+
+const (
+	// KSUID timestamps are seconds since 2014-05-13T16:53:20Z
+	ksuidEpoch    = 1400000000
+	ksuidLength   = 27
+	base62Digits  = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	ulidLength    = 26
+	crockfordBase = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// Returns the KSUID made of the 32 bits timestamp, in seconds, and the 128
+// bits payload
+func ksuid(t time.Time, payload []byte) string {
+	data := make([]byte, 20)
+	// Earlier times can't be represented, and sort first
+	seconds := uint32(0)
+	if t.Unix() > ksuidEpoch {
+		seconds = uint32(t.Unix() - ksuidEpoch)
+	}
+	data[0], data[1], data[2], data[3] = byte(seconds>>24), byte(seconds>>16), byte(seconds>>8), byte(seconds)
+	copy(data[4:], payload)
+	return encodeBase(data, base62Digits, ksuidLength)
+}
+
+// Returns the ULID made of the 48 bits timestamp, in milliseconds, and the
+// first 80 bits of entropy
+func ulid(t time.Time, entropy []byte) string {
+	data := make([]byte, 16)
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		data[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(data[6:], entropy)
+	return encodeBase(data, crockfordBase, ulidLength)
+}
+
+// Encodes the big endian number in data with the digits of alphabet, left
+// padded with zero digits to length
+func encodeBase(data []byte, alphabet string, length int) string {
+	n := new(big.Int).SetBytes(data)
+	base := big.NewInt(int64(len(alphabet)))
+	digit := new(big.Int)
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		n.DivMod(n, base, digit)
+		encoded[i] = alphabet[digit.Int64()]
+	}
+	return string(encoded)
+}
@@ -0,0 +1,274 @@
+package riak
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigStruct of a link from the objects to related ones, written as a
+// Link header. Each setting is interpolated like Index, e.g. a key of
+// "%{request_id}" links every message to the request it belongs to.
+type LinkConfig struct {
+	// Bucket of the linked object, defaulting to the one of the object
+	Bucket string
+	Key    string
+	Tag    string
+}
+
+// A linkTemplate renders the link of a message
+type linkTemplate struct {
+	bucket *template
+	key    *template
+	tag    *template
+}
+
+// Compiles the links of a route. Riak only parses and walks links within
+// the default bucket type, where the objects of the route must be: a route
+// with another one is rejected here, and messages interpolated or given a
+// TTL bucket type of another one when they are linked.
+func compileLinks(conf *RiakOutputConfig) (links []*linkTemplate, err error) {
+	if len(conf.Links) == 0 {
+		return
+	}
+	if !linkableType(conf.TypeName) && !strings.Contains(conf.TypeName, "%{") {
+		return nil, fmt.Errorf("Links require the default bucket type, not %s", conf.TypeName)
+	}
+	for _, linkConf := range conf.Links {
+		if len(linkConf.Key) == 0 {
+			return nil, fmt.Errorf("Link without a key")
+		}
+		// Riak rejects links without a tag
+		if len(linkConf.Tag) == 0 {
+			return nil, fmt.Errorf("Link without a tag")
+		}
+		link := new(linkTemplate)
+		for _, setting := range []struct {
+			source string
+			target **template
+		}{
+			{linkConf.Bucket, &link.bucket},
+			{linkConf.Key, &link.key},
+			{linkConf.Tag, &link.tag},
+		} {
+			if *setting.target, err = compileTemplate(setting.source); err != nil {
+				return nil, err
+			}
+		}
+		links = append(links, link)
+	}
+	return
+}
+
+// Whether objects of the bucket type can have links
+func linkableType(bucketType string) bool {
+	return bucketType == "" || bucketType == "default"
+}
+
+// Adds the links of the route to the object, failing when it isn't in the
+// default bucket type. A link is skipped when an interpolation fails or its
+// key or tag is empty, as messages may lack the fields relating them to
+// others.
+func (o *RiakOutput) addLinks(obj *RiakObject, r *riakRoute, coordinates *RiakCoordinates, msg *message.Message) error {
+	if len(r.links) > 0 && !linkableType(obj.BucketType) {
+		return fmt.Errorf("Links require the default bucket type, not %s", obj.BucketType)
+	}
+	for _, t := range r.links {
+		var values [3]string
+		var err error
+		for i, part := range []*template{t.bucket, t.key, t.tag} {
+			if values[i], err = part.Render(coordinates, msg); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		link := RiakLink{
+			Bucket: o.sanitizer.Sanitize(values[0]),
+			Key:    o.sanitizer.Sanitize(values[1]),
+			Tag:    values[2],
+		}
+		if len(link.Key) == 0 || len(link.Tag) == 0 {
+			continue
+		}
+		if t.bucket.Empty() {
+			link.Bucket = obj.Bucket
+		}
+		obj.Links = append(obj.Links, link)
+	}
+	return nil
+}
+
+var (
+	linkTargetRegexp = regexp.MustCompile(`<([^>]*)>([^<]*)`)
+	linkTagRegexp    = regexp.MustCompile(`riaktag="([^"]*)"`)
+)
+
+// Parses the values of Link headers. Links without a riaktag, like the one
+// to the bucket, are skipped.
+func parseLinks(headers []string) (links []RiakLink) {
+	for _, header := range headers {
+		for _, match := range linkTargetRegexp.FindAllStringSubmatch(header, -1) {
+			tag := linkTagRegexp.FindStringSubmatch(match[2])
+			if tag == nil {
+				continue
+			}
+			link, ok := parseLinkPath(match[1])
+			if !ok {
+				continue
+			}
+			link.Tag, _ = url.QueryUnescape(tag[1])
+			links = append(links, link)
+		}
+	}
+	return
+}
+
+// Parses /buckets/<bucket>/keys/<key> and the legacy /riak/<bucket>/<key>
+// paths
+func parseLinkPath(path string) (link RiakLink, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, part := range parts {
+		if parts[i], ok = unescapePath(part); !ok {
+			return
+		}
+	}
+	switch {
+	case len(parts) == 4 && parts[0] == "buckets" && parts[2] == "keys":
+		link = RiakLink{Bucket: parts[1], Key: parts[3]}
+	case len(parts) == 3 && parts[0] == "riak":
+		link = RiakLink{Bucket: parts[1], Key: parts[2]}
+	default:
+		return link, false
+	}
+	return link, true
+}
+
+func unescapePath(s string) (string, bool) {
+	unescaped, err := url.PathUnescape(s)
+	return unescaped, err == nil
+}
+
+// A RiakReader fetches the objects written by the output, decrypting,
+// decompressing and reassembling them, and walks the links between them.
+type RiakReader struct {
+	// Riak server address, e.g. "http://localhost:8098"
+	Server string
+	// Keys of encrypted objects
+	Keys   KeyRing
+	client *http.Client
+}
+
+func NewRiakReader(server string, keys KeyRing, timeout time.Duration) *RiakReader {
+	return &RiakReader{
+		Server: strings.TrimSuffix(server, "/"),
+		Keys:   keys,
+		client: &http.Client{
+			Timeout: timeout,
+			// Compressed values are decompressed by Decompress, after decryption
+			Transport: &http.Transport{DisableCompression: true},
+		},
+	}
+}
+
+// Fetches an object, with its links. The chunks of split objects are
+// fetched and joined, then the value is decrypted and decompressed.
+func (r *RiakReader) Fetch(bucketType string, bucket string, key string) (obj *RiakObject, err error) {
+	if obj, err = r.get(bucketType, bucket, key); err != nil {
+		return nil, err
+	}
+	if err = r.join(obj); err != nil {
+		return nil, err
+	}
+	if err = r.Keys.Open(obj); err != nil {
+		return nil, err
+	}
+	if err = Decompress(obj); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Fetches the objects the object links to with the tag, or with any tag if
+// empty, in the order of the links
+func (r *RiakReader) Walk(obj *RiakObject, tag string) (linked []*RiakObject, err error) {
+	for _, link := range obj.Links {
+		if len(tag) > 0 && link.Tag != tag {
+			continue
+		}
+		var target *RiakObject
+		if target, err = r.Fetch("", link.Bucket, link.Key); err != nil {
+			return nil, err
+		}
+		linked = append(linked, target)
+	}
+	return
+}
+
+// Fetches an object as stored
+func (r *RiakReader) get(bucketType string, bucket string, key string) (obj *RiakObject, err error) {
+	obj = &RiakObject{BucketType: bucketType, Bucket: bucket, Key: key}
+	response, err := r.client.Get(r.Server + obj.Path())
+	if err != nil {
+		return nil, fmt.Errorf("Error executing fetch request: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Fetch response reading in error: %s", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	obj.Value = body
+	obj.ContentType = response.Header.Get("Content-Type")
+	obj.ContentEncoding = response.Header.Get("Content-Encoding")
+	for name, values := range response.Header {
+		if strings.HasPrefix(name, "X-Riak-Meta-") && len(values) > 0 {
+			obj.SetMeta(strings.TrimPrefix(name, "X-Riak-Meta-"), values[0])
+		}
+	}
+	obj.Links = parseLinks(response.Header["Link"])
+	return
+}
+
+// Appends the values of the chunks of a split object to its own, dropping
+// the links to them. Chunks are found at the key of the object followed by
+// their index, in its bucket type, whatever the order of the links or
+// whether there are any.
+func (r *RiakReader) join(obj *RiakObject) error {
+	count, ok := obj.UserMeta[metaChunks]
+	if !ok {
+		return nil
+	}
+	chunks, err := strconv.Atoi(count)
+	if err != nil || chunks < 1 {
+		return fmt.Errorf("Invalid chunk count: %s", count)
+	}
+	for i := 1; i < chunks; i++ {
+		chunk, err := r.get(obj.BucketType, obj.Bucket, obj.Key+"."+strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		if chunk.UserMeta[metaChunk] != strconv.Itoa(i) || chunk.UserMeta[metaChunkOf] != obj.Key {
+			return fmt.Errorf("Object %s isn't chunk %d of %s", chunk.Key, i, obj.Key)
+		}
+		obj.Value = append(obj.Value, chunk.Value...)
+	}
+	links := obj.Links[:0]
+	for _, link := range obj.Links {
+		if link.Tag != chunkTag {
+			links = append(links, link)
+		}
+	}
+	obj.Links = links
+	delete(obj.UserMeta, metaChunks)
+	return nil
+}
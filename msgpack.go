@@ -0,0 +1,289 @@
+package riak
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"math"
+	"sort"
+)
+
+// MessagePack formatter encodes the same fields as the clean formatter, as a
+// MessagePack map (http://msgpack.org)
+type MsgpackMessageFormatter struct {
+	clean *CleanMessageFormatter
+}
+
+func NewMsgpackMessageFormatter(clean *CleanMessageFormatter) *MsgpackMessageFormatter {
+	return &MsgpackMessageFormatter{clean: clean}
+}
+
+func (f *MsgpackMessageFormatter) Format(m *message.Message) (doc []byte, err error) {
+	return f.clean.encode(m, func(b *bytes.Buffer, d document) {
+		writeMsgpack(b, d)
+	})
+}
+
+func (f *MsgpackMessageFormatter) ContentType() string {
+	return "application/x-msgpack"
+}
+
+func writeMsgpack(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case int64:
+		writeMsgpackInt(b, v)
+	case float64:
+		b.WriteByte(0xcb)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case string:
+		writeMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda)
+		b.WriteString(v)
+	case []byte:
+		writeMsgpackHeader(b, len(v), 0, 0, 0xc4, 0xc5)
+		b.Write(v)
+	case rawValue:
+		writeMsgpack(b, v.decode())
+	case []interface{}:
+		writeMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc)
+		for _, item := range v {
+			writeMsgpack(b, item)
+		}
+	case document:
+		writeMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde)
+		for _, field := range v {
+			writeMsgpack(b, field.name)
+			writeMsgpack(b, field.value)
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde)
+		for _, k := range sortedKeys(v) {
+			writeMsgpack(b, k)
+			writeMsgpack(b, v[k])
+		}
+	default:
+		writeMsgpack(b, fmt.Sprint(v))
+	}
+}
+
+// Writes the smallest integer representation holding v
+func writeMsgpackInt(b *bytes.Buffer, v int64) {
+	switch {
+	case v >= 0 && v < 128:
+		b.WriteByte(byte(v))
+	case v < 0 && v >= -32:
+		b.WriteByte(byte(int8(v)))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		b.WriteByte(0xd0)
+		b.WriteByte(byte(int8(v)))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		b.WriteByte(0xd1)
+		binary.Write(b, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b.WriteByte(0xd2)
+		binary.Write(b, binary.BigEndian, int32(v))
+	default:
+		b.WriteByte(0xd3)
+		binary.Write(b, binary.BigEndian, v)
+	}
+}
+
+// Writes the header of a string, binary, array or map of n items: the fixed
+// size tag when n < fixMax, else the 8 bit length tag if the type has one,
+// else the 16 bit length tag or the 32 bit one which follows it.
+func writeMsgpackHeader(b *bytes.Buffer, n int, fix byte, fixMax int, tag8 byte, tag16 byte) {
+	switch {
+	case n < fixMax:
+		b.WriteByte(fix | byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		b.WriteByte(tag8)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		b.WriteByte(tag16)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(tag16 + 1)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+// Decodes a MessagePack value, as written by the msgpack format. Maps are
+// decoded to map[string]interface{}, arrays to []interface{}, integers to
+// int64 (uint64 above math.MaxInt64) and floats to float64.
+func DecodeMsgpack(data []byte) (value interface{}, err error) {
+	d := &msgpackDecoder{byteReader{data: data}}
+	if value, err = d.decode(); err == nil && d.pos != len(data) {
+		err = fmt.Errorf("%d trailing bytes after MessagePack value", len(data)-d.pos)
+	}
+	return
+}
+
+// Reads the big endian data of the binary formats
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (d *byteReader) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errTruncated
+	}
+	p := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return p, nil
+}
+
+// Reads a big endian unsigned integer of n bytes
+func (d *byteReader) uint(n int) (uint64, error) {
+	p, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range p {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+type msgpackDecoder struct {
+	byteReader
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	p, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := p[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(int(c & 0x0f))
+	case c >= 0x80 && c <= 0x8f:
+		return d.mapping(int(c & 0x0f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		p, err := d.next(int(n))
+		return append([]byte(nil), p...), err
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), err
+	case 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n))
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	p, err := d.next(n)
+	return string(p), err
+}
+
+func (d *msgpackDecoder) array(n int) (interface{}, error) {
+	// Every item takes at least one byte
+	if n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	a := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapping(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
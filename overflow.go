@@ -0,0 +1,208 @@
+package riak
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Overflow policies, choosing what happens to batches the committers can't
+// keep up with
+const (
+	// Wait for a committer, stalling the router
+	overflowBlock = "block"
+	// Queue batches, dropping the newest messages beyond the memory budget
+	overflowDropNewest = "drop_newest"
+	// Queue batches, dropping the oldest messages beyond the memory budget
+	overflowDropOldest = "drop_oldest"
+	// Queue batches, spooling them to disk beyond the memory budget
+	overflowSpool = "spool"
+)
+
+// An overflowQueue holds the batches waiting for a committer, so that the
+// receiver never waits for Riak. Queued values are kept within a memory
+// budget: beyond it, batches are spooled to disk or messages are dropped,
+// the least severe ones first.
+type overflowQueue struct {
+	lock     sync.Mutex
+	nonEmpty *sync.Cond
+	policy   string
+	// Maximum size of the queued values, in bytes
+	budget int
+	size   int
+	// Oldest first
+	batches [][]*RiakObject
+	// Holds the batches queued after the ones in memory, nil unless spooling
+	spool  *spool
+	closed bool
+}
+
+func newOverflowQueue(policy string, budget int, spool *spool) *overflowQueue {
+	q := &overflowQueue{policy: policy, budget: budget, spool: spool}
+	q.nonEmpty = sync.NewCond(&q.lock)
+	return q
+}
+
+// Creates the queue of the configured overflow policy, nil when blocking
+func newOverflow(conf *RiakOutputConfig) (q *overflowQueue, err error) {
+	var s *spool
+	switch conf.OverflowPolicy {
+	case overflowBlock:
+		return nil, nil
+	case overflowDropNewest, overflowDropOldest:
+	case overflowSpool:
+		if len(conf.SpoolDir) == 0 {
+			return nil, fmt.Errorf("spool_dir is required to spool batches")
+		}
+		if s, err = newSpool(conf.SpoolDir); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported overflow_policy: %s", conf.OverflowPolicy)
+	}
+	if conf.OverflowMemory <= 0 {
+		return nil, fmt.Errorf("Invalid overflow_memory: %d", conf.OverflowMemory)
+	}
+	return newOverflowQueue(conf.OverflowPolicy, conf.OverflowMemory, s), nil
+}
+
+func batchSize(batch []*RiakObject) (size int) {
+	for _, obj := range batch {
+		size += len(obj.Value)
+	}
+	return
+}
+
+// Queues a batch, returning how many messages were dropped to stay within
+// the budget, and whether the batch was spooled. A batch which can't be
+// spooled is dropped along with the error.
+func (q *overflowQueue) Push(batch []*RiakObject) (dropped int, spooled bool, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.nonEmpty.Signal()
+	size := batchSize(batch)
+	if q.spool != nil && (q.spool.Len() > 0 || q.size+size > q.budget) {
+		// Once spooling, batches keep going to the spool to stay in order
+		if err = q.spool.Push(batch); err != nil {
+			dropped = len(batch)
+		}
+		return dropped, err == nil, err
+	}
+	q.batches = append(q.batches, batch)
+	q.size += size
+	if q.size > q.budget {
+		dropped = q.shed()
+	}
+	return
+}
+
+// Drops messages until the queue fits the budget: the least severe ones
+// first, and among them the oldest or newest ones depending on the policy.
+func (q *overflowQueue) shed() (dropped int) {
+	for q.size > q.budget {
+		worst := int32(-1)
+		for _, batch := range q.batches {
+			for _, obj := range batch {
+				if obj.Severity > worst {
+					worst = obj.Severity
+				}
+			}
+		}
+		if worst < 0 {
+			break
+		}
+		dropped += q.dropSeverity(worst)
+	}
+	kept := q.batches[:0]
+	for _, batch := range q.batches {
+		if len(batch) > 0 {
+			kept = append(kept, batch)
+		}
+	}
+	q.batches = kept
+	return
+}
+
+// Drops the messages of a severity until the queue fits the budget
+func (q *overflowQueue) dropSeverity(severity int32) (dropped int) {
+	newest := q.policy == overflowDropNewest
+	for j := range q.batches {
+		i := j
+		if newest {
+			i = len(q.batches) - 1 - j
+		}
+		batch := q.batches[i]
+		for k := range batch {
+			if q.size <= q.budget {
+				break
+			}
+			if newest {
+				k = len(batch) - 1 - k
+			}
+			if batch[k] != nil && batch[k].Severity == severity {
+				q.size -= len(batch[k].Value)
+				batch[k] = nil
+				dropped++
+			}
+		}
+		kept := batch[:0]
+		for _, obj := range batch {
+			if obj != nil {
+				kept = append(kept, obj)
+			}
+		}
+		q.batches[i] = kept
+	}
+	return
+}
+
+// Removes and returns the oldest batch, waiting for one. ok is false once
+// the queue is closed and empty.
+func (q *overflowQueue) Pop() (batch []*RiakObject, ok bool, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.batches) == 0 && !q.spooled() && !q.closed {
+		q.nonEmpty.Wait()
+	}
+	if len(q.batches) > 0 {
+		batch = q.batches[0]
+		q.batches[0] = nil
+		q.batches = q.batches[1:]
+		q.size -= batchSize(batch)
+		return batch, true, nil
+	}
+	// Spooled batches are left for the next run once closed
+	if q.spooled() && !q.closed {
+		batch, err = q.spool.Pop()
+		return batch, true, err
+	}
+	return nil, false, nil
+}
+
+func (q *overflowQueue) spooled() bool {
+	return q.spool != nil && q.spool.Len() > 0
+}
+
+// Spools a batch which failed to be written, to be written after the ones
+// queued meanwhile
+func (q *overflowQueue) Spool(batch []*RiakObject) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.nonEmpty.Signal()
+	return q.spool.Push(batch)
+}
+
+// Removes and returns the batches in memory
+func (q *overflowQueue) Drain() (batches [][]*RiakObject) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	batches, q.batches, q.size = q.batches, nil, 0
+	return
+}
+
+// Closes the queue, once the last batch is pushed
+func (q *overflowQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.nonEmpty.Broadcast()
+}
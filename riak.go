@@ -2,43 +2,102 @@ package riak
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"hash/fnv"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strconv"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
 
 // Output plugin that index messages to a riak cluster
 type RiakOutput struct {
-	clusterName          string
-	indexName            string
-	typeName             string
-	flushInterval        uint32
-	flushCount           int
-	batchChan            chan []byte
-	backChan             chan []byte
-	format               string
-	timestamp            string
+	clusterName   string
+	flushInterval uint32
+	flushCount    int
+	// Channels of the batches to write: one shared by all the committers,
+	// or one per committer when ordering writes by key
+	batchChans []chan []*RiakObject
+	// Pool of the empty batch buffers
+	backChan               chan []*RiakObject
 	riakIndexFromTimestamp bool
-	messageFormatter MessageFormatter
-	// Used to index documents
-	bulkIndexer BulkIndexer
-	// Specify the document id or field name
-	id string
+	// Configured routes, in order, followed by the default route
+	routes []*riakRoute
+	// Used to index documents, one per committer
+	bulkIndexers []BulkIndexer
+	// Number of committers
+	concurrency int
+	// Sizes batches, nil unless adaptive
+	adaptiveFlush *adaptiveFlush
+	// Queues batches for the committers, nil when blocking
+	overflow *overflowQueue
+	// Circuit breaker of the cluster, and whether batches are spooled while
+	// it's open
+	clusterBreaker *circuitBreaker
+	breakerSpool   bool
+	// Logs breaker state changes, set when running
+	runner OutputRunner
+	// Time left to write the remaining batches once the input channel is
+	// closed, 0 for no limit
+	shutdownTimeout time.Duration
+	// Closed by the receiver once the input channel is closed
+	stopping chan struct{}
+	// Closed by Run once the shutdown timeout expires, ending the sends of
+	// the receiver, and by the receiver once it returns
+	abandoned    chan struct{}
+	receiverDone chan struct{}
+	// Batches not written yet, nil without shutdown timeout
+	tracker *batchTracker
+	// Where the batches left at the shutdown timeout go without spool
+	deadLetterFile string
+	stats          *riakStats
+	// Of the nodes of the cluster, in order
+	nodeStats []*nodeStats
+	// Store request latencies, in nanoseconds, and batch sizes since the
+	// last stats message
+	latencies     *sampleWindow
+	batchSizes    *sampleWindow
+	statsInterval time.Duration
+	hostname      string
+	// Maximum size of the values, 0 for none, and what happens to larger ones
+	maxObjectSize int
+	sizePolicy    string
 	// Specify a timeout value in milliseconds for bulk request to complete.
 	// Default is 0 (infinite)
-	http_timeout	     uint32
+	http_timeout uint32
+	// Bucket of the documents whose payload is not valid JSON
+	payloadErrorBucket *template
+	// Applies the transform rules, nil without any
+	transformer *messageTransformer
+	// Compresses stored values, nil when they aren't compressed
+	compressor *compressor
+	// Encrypts stored values, nil when they aren't encrypted
+	cipher *envelopeCipher
+	// Where messages which can't be stored go, if anywhere
+	deadLetterBucket string
+	deadLetterType   string
+	// Name of the plugin, recorded in dead letters
+	pluginName string
+	// Interpolation settings of bucket and key names
+	interpolateBytes   string
+	interpolateMissing string
+	location           *time.Location
+	// Sanitizes bucket and key names
+	sanitizer *nameSanitizer
+	// Recently written Uuids, nil without deduplication
+	dedupCache *uuidCache
+	ttl        *ttlPolicy
 }
 
 // ConfigStruct for RiakOutput plugin
@@ -47,201 +106,902 @@ type RiakOutputConfig struct {
 	Cluster string
 	// Name of the index where message will be inserted
 	Index string
-	// Name of Riak record type to create
+	// Riak bucket type of the bucket the messages are stored in
 	TypeName string `toml:"type_name"`
 	// Interval at which accumulated messages should be bulk indexed to Riak, in milliseconds (default 1000, i.e. 1 second).
 	FlushInterval uint32 `toml:"flush_interval"`
 	// Number of messages that triggers a bulk indexation (default to 10)
 	FlushCount int `toml:"flush_count"`
-	// Format of the document.
+	// Size in bytes of the stored values that triggers a bulk indexation,
+	// whichever of the count and size is reached first (default 0, none)
+	FlushBytes int `toml:"flush_bytes"`
+	// Adapt the number of messages of bulk indexations to the write latency
+	// and error rate, starting from flush_count: batches shrink when writes
+	// fail or take longer than flush_latency_target, and grow back while
+	// writes are well within it.
+	AdaptiveFlush bool `toml:"adaptive_flush"`
+	// Bounds of the adaptive number of messages (default 1 to 1000)
+	FlushCountMin int `toml:"flush_count_min"`
+	FlushCountMax int `toml:"flush_count_max"`
+	// Target write latency of a batch, in milliseconds (default 500)
+	FlushLatencyTarget uint32 `toml:"flush_latency_target"`
+	// Number of batches written concurrently, each by its own committer with
+	// its own connection (default 1)
+	Concurrency int
+	// Write objects with the same bucket type, bucket and key in order, by
+	// always handing them over to the same committer
+	OrderByKey bool `toml:"order_by_key"`
+	// What happens to batches while the committers are busy: "block"
+	// (default, waiting for a committer), or queuing them within
+	// overflow_memory and beyond it "drop_newest" or "drop_oldest" messages,
+	// the least severe ones first, or "spool" batches to spool_dir
+	OverflowPolicy string `toml:"overflow_policy"`
+	// Memory budget of the queued batches, in bytes (default 64MiB)
+	OverflowMemory int `toml:"overflow_memory"`
+	// Directory of the spooled batches
+	SpoolDir string `toml:"spool_dir"`
+	// Time given to write the remaining batches once Heka shuts down, in
+	// milliseconds (default 0, no limit). Batches left at the deadline are
+	// spooled with the spool overflow_policy, written to dead_letter_file
+	// otherwise, and a summary of them is logged.
+	ShutdownTimeout uint32 `toml:"shutdown_timeout"`
+	// File the batches left at the shutdown timeout are appended to, one JSON
+	// object per line, when not spooled
+	DeadLetterFile string `toml:"dead_letter_file"`
+	// Maximum size in bytes of the stored values, after compression and
+	// encryption (default 0, none). Riak degrades above about 1MB.
+	MaxObjectSize int `toml:"max_object_size"`
+	// What happens to larger objects: "truncate" (default, cutting the
+	// payload of the message and appending a marker), "split" (in linked
+	// chunks), "dead_letter" (to the dead letter bucket, where
+	// max_object_size isn't applied: the whole message is kept, which is
+	// larger than the object) or "drop"
+	MaxObjectPolicy string `toml:"max_object_policy"`
+	// Interval at which a heka.riak-output.stats message is injected, with
+	// store request latency and batch size percentiles and node errors, in
+	// milliseconds (default 0, never). The message_matcher of the output
+	// should exclude them (Type != 'heka.riak-output.stats'); those of the
+	// output itself are skipped anyway.
+	StatsInterval uint32 `toml:"stats_interval"`
+	// Format of the document: "raw", "clean", "payload", "msgpack" or "cbor".
+	// The msgpack and cbor formats encode the same fields as "clean".
 	Format string
-	// If the format is “clean”, then the Fields can be used to specify that only specific message data should be indexed 
+	// If the format is “clean”, then the Fields can be used to specify that only specific message data should be indexed
 	Fields []string
 	// Timestamp format.
 	Timestamp string
-	// Riak server address (default: "http://localhost:8087")
+	// Riak server address (default: "http://localhost:8098")
 	Server string
-	// Use Timestamp value for indexing instead of current time 
+	// Addresses of the nodes of the cluster, in place of Server. Objects are
+	// stored on the next node when one fails.
+	Servers []string
+	// Number of consecutive failures opening the circuit breaker of a node,
+	// or of the cluster, skipping the node or failing batches right away
+	// (default 5)
+	BreakerThreshold int `toml:"breaker_threshold"`
+	// Time an open breaker waits before probing the node or cluster with
+	// /ping, in milliseconds (default 30000)
+	BreakerCooldown uint32 `toml:"breaker_cooldown"`
+	// What happens to batches while the breaker of the cluster is open:
+	// "fail" (default, they are lost) or "spool" (requires the spool
+	// overflow_policy; they are written once the cluster is back, after the
+	// batches queued meanwhile)
+	BreakerOpenPolicy string `toml:"breaker_open_policy"`
+	// Use Timestamp value for indexing instead of current time
 	RiakIndexFromTimestamp bool
 	// Document ID
 	Id string
+	// How keys are generated: "template" (default, the Id interpolation, or
+	// a key generated by Riak without an Id), "uuid" (the message Uuid),
+	// "ksuid" or "ulid" (time sortable, from the message timestamp and Uuid)
+	// or "hash" (SHA-256 of the formatted document)
+	KeyStrategy string `toml:"key_strategy"`
+	// Write objects keyed by their message (key_strategy "uuid", "ksuid",
+	// "ulid" or "hash") only if they don't exist yet, with If-None-Match,
+	// so that messages written twice are stored once. The Uuids of the
+	// recently written messages are also kept in memory to skip repeats
+	// without a round trip.
+	Dedup bool
+	// Number of Uuids kept in memory for deduplication (default 10000)
+	DedupCacheSize int `toml:"dedup_cache_size"`
+	// How long objects are kept (e.g. "72h" or "30d"), forever by default.
+	// Every TTL needs a bucket type in ttl_bucket_types.
+	TTL string `toml:"ttl"`
+	// TTL by message severity, by number or name (e.g. debug = "3d"),
+	// overriding the default TTL. Routes may also have their own.
+	SeverityTTL map[string]string `toml:"severity_ttl"`
+	// Bucket types of the TTLs (e.g. "3d" = "short_lived"), whose backends
+	// expire objects after them in multi-backend setups: Riak backends
+	// don't expire single objects. The TTL and expiry are also written in
+	// the user metadata of the objects, for information only.
+	TTLBucketTypes map[string]string `toml:"ttl_bucket_types"`
 	// Timeout
 	HTTPTimeout uint32 `toml:"http_timeout"`
 	// Fields to ignore formatting on
 	RawBytesFields []string `toml:"raw_bytes_fields"`
+	// How the representation of dynamic fields is written: "none" (default),
+	// "sibling" (as a "<name>_representation" key) or "nested" (as a
+	// {"value", "representation"} object)
+	FieldRepresentation string `toml:"field_representation"`
+	// Expand dotted dynamic field names (e.g. "http.status") into nested objects
+	ExpandFieldNames bool `toml:"expand_field_names"`
+	// What to do when an expanded name collides with an existing value, like
+	// "http" alongside "http.status": "value_key" (default, store the scalar
+	// under "_value" in the object, other collisions are kept flat), "flat"
+	// (keep the colliding field under its dotted name), "overwrite" (last
+	// value wins) or "error" (fail the message)
+	FieldNameCollision string `toml:"field_name_collision"`
+	// Parse the payload as JSON and either "merge" its top-level keys into
+	// the clean document or "nest" it under PayloadJSONKey (default "none")
+	PayloadJSON string `toml:"payload_json"`
+	// Key of the nested payload document (default "Payload")
+	PayloadJSONKey string `toml:"payload_json_key"`
+	// What to do with payloads which are not valid JSON: "keep" them as a
+	// string (default), "drop" the message or keep them and store the
+	// document in the "error_bucket"
+	PayloadJSONError string `toml:"payload_json_error"`
+	// Bucket of the documents whose payload is not valid JSON, interpolated
+	// like Index
+	PayloadErrorBucket string `toml:"payload_error_bucket"`
+	// Dynamic fields to include and exclude from clean documents, as glob
+	// patterns (e.g. "debug.*") or regular expressions prefixed with "re:".
+	// By default all of them are included.
+	IncludeFields []string `toml:"include_fields"`
+	ExcludeFields []string `toml:"exclude_fields"`
+	// Rules transforming messages before they are formatted, to redact,
+	// hash or truncate sensitive data. The values each rule transformed are
+	// counted in the reports.
+	Transforms []TransformConfig
+	// File holding the AES key (16, 24 or 32 bytes, hex encoded) used to
+	// encrypt stored values with AES-GCM. Values are bound to the bucket
+	// type, bucket and key of their object, so objects without a key are
+	// keyed by the message UUID. Values aren't encrypted by default.
+	EncryptionKeyFile string `toml:"encryption_key_file"`
+	// ID of the encryption key, stored in the user metadata of the objects
+	// so that they can be decrypted after the key is rotated
+	EncryptionKeyId string `toml:"encryption_key_id"`
+	// Compression of stored values: "none" (default), "gzip", "snappy" or
+	// "zstd". Values are compressed before being encrypted.
+	Compression string
+	// Values smaller than this number of bytes aren't compressed (default
+	// 1024)
+	CompressionMinSize int `toml:"compression_min_size"`
+	// Write quorums: a number of replicas, "one", "quorum" or "all" (default
+	// to the bucket properties)
+	W  string `toml:"w"`
+	DW string `toml:"dw"`
+	PW string `toml:"pw"`
+	// Encoding of bytes fields interpolated in bucket and key names: "hex"
+	// (default) or "base64" (URL safe)
+	InterpolateBytes string `toml:"interpolate_bytes"`
+	// What fields missing from a message interpolate to: "time" (default,
+	// the field name is used as a time layout), "empty" or "error" (the
+	// message goes to the dead letter bucket, or a generated key is used for
+	// the Id)
+	InterpolateMissing string `toml:"interpolate_missing"`
+	// Characters allowed in bucket types, buckets and keys, as the body of a
+	// regular expression character class (e.g. "A-Za-z0-9_.-"). Any
+	// character is allowed by default. Names are URL encoded in any case.
+	NameAllowedChars string `toml:"name_allowed_chars"`
+	// Replacement of runs of characters which aren't allowed (default "_")
+	NameReplacement string `toml:"name_replacement"`
+	// Maximum length in bytes of bucket types, buckets and keys. Longer
+	// names are truncated and end with a hash of the full name. No limit by
+	// default.
+	NameMaxLength int `toml:"name_max_length"`
+	// Time zone of the time layouts interpolated in bucket and key names
+	// (e.g. "Europe/Paris"). By default, the message timestamp is in UTC and
+	// the current time in the local time zone.
+	TimeZone string `toml:"time_zone"`
+	// Bucket storing the messages which can't be formatted or located, as
+	// protobuf encoded messages along with the error. They are dropped by
+	// default.
+	DeadLetterBucket string `toml:"dead_letter_bucket"`
+	// Bucket type of the dead letter bucket
+	DeadLetterType string `toml:"dead_letter_type"`
+	// Links from the objects to related ones, e.g. from the messages of a
+	// request to its first one, written as Link headers. The bucket, key and
+	// tag of each link are interpolated like Index, and a link is left out
+	// when an interpolation fails or its key or tag is empty. Riak only
+	// supports links within the default bucket type: messages routed to
+	// another one, by type_name or ttl_bucket_types, fail. Links are
+	// followed with RiakReader.Walk.
+	Links []LinkConfig
+	// Routes, each with a message matcher, and their own bucket, format and
+	// write options. Messages go to the first route they match, or to the
+	// default route defined by the settings above.
+	Routes []RouteConfig
 }
 
 func (o *RiakOutput) ConfigStruct() interface{} {
 	return &RiakOutputConfig{
-		Cluster:              "riak",
-		Index:                "heka-%{2014.05.05}",
-		TypeName:             "message",
-		FlushInterval:        1000,
-		FlushCount:           10,
-		Format:               "clean",
-		Timestamp:            "2014-05-05T00:00:00.000Z",
-		Server:               "http://localhost:8087",
+		Cluster:                "riak",
+		Index:                  "heka-%{2014.05.05}",
+		TypeName:               "default",
+		FlushInterval:          1000,
+		FlushCount:             10,
+		Concurrency:            1,
+		OverflowPolicy:         overflowBlock,
+		OverflowMemory:         64 * 1024 * 1024,
+		FlushCountMin:          1,
+		FlushCountMax:          1000,
+		FlushLatencyTarget:     500,
+		Format:                 "clean",
+		Timestamp:              "2014-05-05T00:00:00.000Z",
+		Server:                 "http://localhost:8098",
+		BreakerThreshold:       5,
+		BreakerCooldown:        30000,
+		BreakerOpenPolicy:      breakerFail,
+		MaxObjectPolicy:        sizeTruncate,
 		RiakIndexFromTimestamp: false,
-		Id:                   "",
-		HTTPTimeout:	      0,
+		Id:                     "",
+		HTTPTimeout:            0,
+		PayloadJSONKey:         "Payload",
+		CompressionMinSize:     1024,
+		NameReplacement:        "_",
+		KeyStrategy:            keyTemplate,
+		DedupCacheSize:         10000,
 	}
 }
 
 func (o *RiakOutput) Init(config interface{}) (err error) {
 	conf := config.(*RiakOutputConfig)
 	o.clusterName = conf.Cluster
-	o.indexName = conf.Index
-	o.typeName = conf.TypeName
 	o.flushInterval = conf.FlushInterval
 	o.flushCount = conf.FlushCount
-	o.batchChan = make(chan []byte)
-	o.backChan = make(chan []byte, 2)
-	o.format = conf.Format
+	if conf.Concurrency < 1 {
+		return fmt.Errorf("Invalid concurrency: %d", conf.Concurrency)
+	}
+	o.concurrency = conf.Concurrency
+	if o.overflow, err = newOverflow(conf); err != nil {
+		return
+	}
+	o.stats = new(riakStats)
+	if conf.MaxObjectSize < 0 {
+		return fmt.Errorf("Invalid max_object_size: %d", conf.MaxObjectSize)
+	}
+	if err = validSizePolicy(conf.MaxObjectPolicy, conf.DeadLetterBucket); err != nil {
+		return
+	}
+	o.maxObjectSize = conf.MaxObjectSize
+	o.sizePolicy = conf.MaxObjectPolicy
+	o.latencies = new(sampleWindow)
+	o.batchSizes = new(sampleWindow)
+	o.statsInterval = time.Duration(conf.StatsInterval) * time.Millisecond
+	o.hostname, _ = os.Hostname()
+	o.stopping = make(chan struct{})
+	o.abandoned = make(chan struct{})
+	o.receiverDone = make(chan struct{})
+	o.shutdownTimeout = time.Duration(conf.ShutdownTimeout) * time.Millisecond
+	o.deadLetterFile = conf.DeadLetterFile
+	o.tracker = nil
+	if o.shutdownTimeout > 0 {
+		o.tracker = newBatchTracker()
+	}
+	o.adaptiveFlush = nil
+	if conf.AdaptiveFlush {
+		if conf.FlushCountMin < 1 || conf.FlushCountMax < conf.FlushCountMin {
+			return fmt.Errorf("Invalid adaptive flush bounds: %d to %d", conf.FlushCountMin, conf.FlushCountMax)
+		}
+		o.adaptiveFlush = newAdaptiveFlush(conf.FlushCount, conf.FlushCountMin, conf.FlushCountMax,
+			time.Duration(conf.FlushLatencyTarget)*time.Millisecond)
+	}
+	o.batchChans = make([]chan []*RiakObject, 1)
+	if conf.OrderByKey {
+		o.batchChans = make([]chan []*RiakObject, o.concurrency)
+	}
+	for i := range o.batchChans {
+		o.batchChans[i] = make(chan []*RiakObject)
+	}
+	// Buffers are filled by the receiver, one per channel, and written by
+	// the committers, one each
+	o.backChan = make(chan []*RiakObject, len(o.batchChans)+o.concurrency)
 	o.riakIndexFromTimestamp = conf.RiakIndexFromTimestamp
-	o.id = conf.Id
 	o.http_timeout = conf.HTTPTimeout
+	if o.payloadErrorBucket, err = compileTemplate(conf.PayloadErrorBucket); err != nil {
+		return
+	}
+	o.deadLetterBucket = conf.DeadLetterBucket
+	o.deadLetterType = conf.DeadLetterType
+	switch o.interpolateBytes = strings.ToLower(conf.InterpolateBytes); o.interpolateBytes {
+	case "", "hex", "base64":
+	default:
+		return fmt.Errorf("Unknown interpolate_bytes: %s", conf.InterpolateBytes)
+	}
+	switch o.interpolateMissing = strings.ToLower(conf.InterpolateMissing); o.interpolateMissing {
+	case "", "time", "empty", "error":
+	default:
+		return fmt.Errorf("Unknown interpolate_missing: %s", conf.InterpolateMissing)
+	}
+	if o.ttl, err = newTTLPolicy(conf.TTL, conf.SeverityTTL, conf.TTLBucketTypes); err != nil {
+		return
+	}
+	o.dedupCache = nil
+	if conf.Dedup {
+		if conf.DedupCacheSize <= 0 {
+			return fmt.Errorf("Invalid dedup_cache_size: %d", conf.DedupCacheSize)
+		}
+		o.dedupCache = newUuidCache(conf.DedupCacheSize)
+	}
+	if o.sanitizer, err = newNameSanitizer(conf.NameAllowedChars, conf.NameReplacement, conf.NameMaxLength); err != nil {
+		return
+	}
+	if len(conf.TimeZone) > 0 {
+		if o.location, err = time.LoadLocation(conf.TimeZone); err != nil {
+			return fmt.Errorf("Unknown time_zone %s: %s", conf.TimeZone, err)
+		}
+	}
+	if len(conf.Transforms) > 0 {
+		if o.transformer, err = newMessageTransformer(conf.Transforms); err != nil {
+			return
+		}
+	}
+	o.routes = make([]*riakRoute, 0, len(conf.Routes)+1)
+	for i, routeConf := range conf.Routes {
+		var r *riakRoute
+		if r, err = newRoute(conf, routeConf); err != nil {
+			return fmt.Errorf("routes[%d]: %s", i, err)
+		}
+		if err = o.ttl.Check(r.ttl, routeConf.TTL); err != nil {
+			return fmt.Errorf("routes[%d]: %s", i, err)
+		}
+		o.routes = append(o.routes, r)
+	}
+	var defaultRoute *riakRoute
+	if defaultRoute, err = newDefaultRoute(conf); err != nil {
+		return
+	}
+	o.routes = append(o.routes, defaultRoute)
+	switch strings.ToLower(conf.Compression) {
+	case "", "none":
+	default:
+		if o.compressor, err = newCompressor(conf.Compression, conf.CompressionMinSize); err != nil {
+			return
+		}
+	}
+	if len(conf.EncryptionKeyFile) > 0 {
+		var key []byte
+		if key, err = LoadKeyFile(conf.EncryptionKeyFile); err != nil {
+			return
+		}
+		if o.cipher, err = newEnvelopeCipher(conf.EncryptionKeyId, key); err != nil {
+			return
+		}
+	}
+	return o.initIndexers(conf)
+}
+
+// Creates the indexers of the committers, and the circuit breakers they share
+func (o *RiakOutput) initIndexers(conf *RiakOutputConfig) (err error) {
+	if conf.BreakerThreshold < 1 {
+		return fmt.Errorf("Invalid breaker_threshold: %d", conf.BreakerThreshold)
+	}
+	switch o.breakerSpool = conf.BreakerOpenPolicy == breakerSpool; conf.BreakerOpenPolicy {
+	case breakerFail:
+	case breakerSpool:
+		if o.overflow == nil || o.overflow.spool == nil {
+			return fmt.Errorf("breaker_open_policy spool requires the spool overflow_policy")
+		}
+	default:
+		return fmt.Errorf("Unsupported breaker_open_policy: %s", conf.BreakerOpenPolicy)
+	}
+	cooldown := time.Duration(conf.BreakerCooldown) * time.Millisecond
+	servers := conf.Servers
+	if len(servers) == 0 {
+		servers = []string{conf.Server}
+	}
+	serverUrls := make([]*url.URL, len(servers))
+	breakers := make([]*circuitBreaker, len(servers))
+	o.nodeStats = make([]*nodeStats, len(servers))
+	for i, server := range servers {
+		if serverUrls[i], err = url.Parse(server); err != nil {
+			return fmt.Errorf("Unable to parse URL [%s]: %s", server, err)
+		}
+		breakers[i] = newCircuitBreaker("node "+serverUrls[i].Host, conf.BreakerThreshold, cooldown, o.logBreaker)
+		o.nodeStats[i] = &nodeStats{name: serverUrls[i].Host}
+	}
+	o.clusterBreaker = newCircuitBreaker(strings.TrimSpace("cluster "+o.clusterName),
+		conf.BreakerThreshold, cooldown, o.logBreaker)
+
+	o.bulkIndexers = make([]BulkIndexer, o.concurrency)
+	for i := range o.bulkIndexers {
+		// Committers start on different nodes
+		indexer := &clusterIndexer{
+			breakers:  breakers,
+			cluster:   o.clusterBreaker,
+			stats:     o.stats,
+			nodeStats: o.nodeStats,
+			latencies: o.latencies,
+			next:      i % len(servers),
+		}
+		for _, serverUrl := range serverUrls {
+			node := NewHttpBulkIndexer(strings.ToLower(serverUrl.Scheme), serverUrl.Host, o.flushCount, o.http_timeout)
+			node.MaxBytes = conf.FlushBytes
+			node.adaptive = o.adaptiveFlush
+			indexer.nodes = append(indexer.nodes, node)
+		}
+		o.bulkIndexers[i] = indexer
+	}
+	return
+}
+
+func (o *RiakOutput) logBreaker(name string, from breakerState, to breakerState) {
+	if o.runner != nil {
+		o.runner.LogMessage(fmt.Sprintf("Circuit breaker of %s is %s, was %s", name, to, from))
+	}
+}
+
+// Creates the formatter of the configured format
+func newMessageFormatter(conf *RiakOutputConfig) (formatter MessageFormatter, err error) {
 	switch strings.ToLower(conf.Format) {
 	case "raw":
-		o.messageFormatter = NewRawMessageFormatter()
-	case "clean":
-		o.messageFormatter = NewCleanMessageFormatter(conf.Fields, conf.Timestamp, conf.RawBytesFields)
+		formatter = NewRawMessageFormatter()
+	case "clean", "msgpack", "cbor":
+		clean := NewCleanMessageFormatter(conf.Fields, conf.Timestamp, conf.RawBytesFields)
+		switch strings.ToLower(conf.FieldRepresentation) {
+		case "", "none":
+		case "sibling":
+			clean.representation = representationSibling
+		case "nested":
+			clean.representation = representationNested
+		default:
+			err = fmt.Errorf("Unknown field_representation: %s", conf.FieldRepresentation)
+			return
+		}
+		if len(conf.IncludeFields) > 0 || len(conf.ExcludeFields) > 0 {
+			if clean.fieldFilter, err = newFieldFilter(conf.IncludeFields, conf.ExcludeFields); err != nil {
+				return
+			}
+		}
+		clean.expandFieldNames = conf.ExpandFieldNames
+		clean.payloadJSONKey = conf.PayloadJSONKey
+		switch strings.ToLower(conf.FieldNameCollision) {
+		case "", "value_key":
+			clean.fieldNameCollision = collisionValueKey
+		case "flat":
+			clean.fieldNameCollision = collisionFlat
+		case "overwrite":
+			clean.fieldNameCollision = collisionOverwrite
+		case "error":
+			clean.fieldNameCollision = collisionError
+		default:
+			err = fmt.Errorf("Unknown field_name_collision: %s", conf.FieldNameCollision)
+			return
+		}
+		switch strings.ToLower(conf.PayloadJSON) {
+		case "", "none":
+		case "merge":
+			clean.payloadJSON = payloadJSONMerge
+		case "nest":
+			clean.payloadJSON = payloadJSONNest
+		default:
+			err = fmt.Errorf("Unknown payload_json: %s", conf.PayloadJSON)
+			return
+		}
+		switch strings.ToLower(conf.PayloadJSONError) {
+		case "", "keep":
+		case "drop":
+			clean.payloadJSONError = payloadErrorDrop
+		case "error_bucket":
+			if len(conf.PayloadErrorBucket) == 0 {
+				err = fmt.Errorf("payload_json_error is error_bucket but no payload_error_bucket is set")
+				return
+			}
+			clean.payloadJSONError = payloadErrorBucket
+		default:
+			err = fmt.Errorf("Unknown payload_json_error: %s", conf.PayloadJSONError)
+			return
+		}
+		switch strings.ToLower(conf.Format) {
+		case "msgpack":
+			formatter = NewMsgpackMessageFormatter(clean)
+		case "cbor":
+			formatter = NewCborMessageFormatter(clean)
+		default:
+			formatter = clean
+		}
 	// case "logstash_v0":
-	// 	o.messageFormatter = NewKibanaFormatter(conf.RawBytesFields)
+	// 	formatter = NewKibanaFormatter(conf.RawBytesFields)
 	case "payload":
-		o.messageFormatter = new(PayloadFormatter)
+		formatter = new(PayloadFormatter)
 	default:
-		o.messageFormatter = NewRawMessageFormatter()
+		formatter = NewRawMessageFormatter()
 	}
-	o.timestamp = conf.Timestamp
-	if serverUrl, err := url.Parse(conf.Server); err == nil {
-		o.bulkIndexer = NewHttpBulkIndexer(strings.ToLower(serverUrl.Scheme), serverUrl.Host, o.flushCount, o.http_timeout)
-		
-	} else {
-		err = fmt.Errorf("Unable to parse URL [%s]: %s", conf.Server, err)
-		return err
-	}
-
 	return
 }
 
 func (o *RiakOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	o.pluginName = or.Name()
+	o.runner = or
+	if o.statsInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go o.statsReporter(or, h, stop)
+	}
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(1 + o.concurrency)
 	go o.receiver(or, &wg)
-	go o.committer(&wg)
-	wg.Wait()
+	if o.overflow != nil {
+		wg.Add(1)
+		go o.dispatcher(or, &wg)
+	}
+	for i := 0; i < o.concurrency; i++ {
+		go o.committer(or, &wg, i)
+	}
+	// The committers return once they have written every batch
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-o.stopping:
+	}
+	if o.shutdownTimeout == 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(o.shutdownTimeout):
+		// The receiver tracks what it holds before returning
+		close(o.abandoned)
+		<-o.receiverDone
+		if err := o.abandon(); err != nil {
+			o.logError(or, err)
+		}
+	}
 	return
 }
 
+// State of the receiver
+type receiverState struct {
+	// Nil once closed
+	inChan chan *PipelinePack
+	// One batch per channel
+	outBatches [][]*RiakObject
+	count      int
+	bytes      int
+	// Messages read while waiting for a committer, so that the input
+	// channel closing is noticed. Their packs are only recycled once
+	// handled, so that the pack pool of Heka bounds them.
+	pending []*PipelinePack
+	// Set once the shutdown timeout expired
+	abandoned bool
+}
+
 // Runs in a separate goroutine, accepting incoming messages, buffering output
 // data until the ticker triggers the buffered data should be put onto the
 // committer channel.
 func (o *RiakOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
-	var pack *PipelinePack
-	var e error
-	var count int
-	ok := true
 	ticker := time.Tick(time.Duration(o.flushInterval) * time.Millisecond)
-	outBatch := make([]byte, 0, 10000)
-	outBytes := make([]byte, 0, 10000)
-	inChan := or.InChan()
+	r := &receiverState{
+		inChan:     or.InChan(),
+		outBatches: make([][]*RiakObject, len(o.batchChans)),
+	}
+	for i := range r.outBatches {
+		r.outBatches[i] = make([]*RiakObject, 0, o.flushCount)
+	}
 
-	for ok {
+	for r.inChan != nil && !r.abandoned {
 		select {
-		case pack, ok = <-inChan:
+		case pack, ok := <-r.inChan:
 			if !ok {
-				// Closed inChan => we're shutting down, flush data
-				if len(outBatch) > 0 {
-					o.batchChan <- outBatch
-				}
-				close(o.batchChan)
+				o.inputClosed(r)
 				break
 			}
-			// `handleMessage()` method recycles the pack.
-			if e = o.handleMessage(pack, &outBytes); e != nil {
-				or.LogError(e)
-			} else {
-				outBatch = append(outBatch, outBytes...)
-				if count = count + 1; o.bulkIndexer.CheckFlush(count, len(outBatch)) {
-					if len(outBatch) > 0 {
-						// This will block until the other side is ready to accept
-						// this batch, so we can't get too far ahead.
-						o.batchChan <- outBatch
-						outBatch = <-o.backChan
-						count = 0
-					}
+			o.receive(or, r, pack)
+		case <-ticker:
+			// This will block until the other side is ready to accept
+			// these batches, freeing us to start on the next ones.
+			o.sendBatches(or, r, true)
+		}
+		for len(r.pending) > 0 && !r.abandoned {
+			pack := r.pending[0]
+			r.pending = r.pending[1:]
+			o.receive(or, r, pack)
+		}
+	}
+	// Closed inChan => we're shutting down, flush data
+	o.sendBatches(or, r, false)
+	if r.abandoned {
+		// The committers are stuck: what's left is saved by Run
+		for _, pack := range r.pending {
+			o.receive(or, r, pack)
+		}
+		for _, outBatch := range r.outBatches {
+			o.tracker.Hold(outBatch)
+		}
+	}
+	if o.overflow != nil {
+		// The dispatcher closes the channels once it's empty
+		o.overflow.Close()
+	} else {
+		for _, batchChan := range o.batchChans {
+			close(batchChan)
+		}
+	}
+	close(o.receiverDone)
+	wg.Done()
+}
+
+// Handles a message, adding its object to the batches, which are handed
+// over once full
+func (o *RiakOutput) receive(or OutputRunner, r *receiverState, pack *PipelinePack) {
+	atomic.AddInt64(&o.stats.received, 1)
+	// `handleMessage()` method recycles the pack.
+	obj, err := o.handleMessage(pack)
+	if err != nil {
+		o.logError(or, err)
+	}
+	if obj == nil {
+		return
+	}
+	// The chunks of split objects go first, so that their links
+	// lead somewhere, through the committer of the object when ordering by
+	// key
+	i := o.partition(obj)
+	for n := 0; n <= len(obj.chunks); n++ {
+		object := obj
+		if n < len(obj.chunks) {
+			object = obj.chunks[n]
+		}
+		r.outBatches[i] = append(r.outBatches[i], object)
+		r.count++
+		if r.bytes += len(object.Value); !r.abandoned && o.bulkIndexers[0].CheckFlush(r.count, r.bytes) {
+			// This will block until the other side is ready to accept
+			// these batches, so we can't get too far ahead.
+			o.sendBatches(or, r, true)
+		}
+	}
+}
+
+// Starts the shutdown timeout once the input channel is closed, tracking the
+// batches which aren't handed over yet
+func (o *RiakOutput) inputClosed(r *receiverState) {
+	r.inChan = nil
+	close(o.stopping)
+	if o.overflow == nil {
+		for _, outBatch := range r.outBatches {
+			o.tracker.Hold(outBatch)
+		}
+	}
+}
+
+// Hands the non empty batches over to the committers, or queues them,
+// replacing them with empty buffers unless shutting down
+func (o *RiakOutput) sendBatches(or OutputRunner, r *receiverState, replace bool) {
+	outBatches := r.outBatches
+	r.count, r.bytes = 0, 0
+	if !replace && o.overflow == nil {
+		// Tracked until written, including while waiting for the others
+		for _, outBatch := range outBatches {
+			o.tracker.Hold(outBatch)
+		}
+	}
+	for i, outBatch := range outBatches {
+		if len(outBatch) == 0 {
+			continue
+		}
+		if o.overflow == nil {
+			if !o.handOver(r, i, outBatch) {
+				return
+			}
+			outBatches[i] = nil
+			if replace {
+				// Committers stuck on a batch may not have given a buffer back
+				select {
+				case outBatches[i] = <-o.backChan:
+				default:
+					outBatches[i] = make([]*RiakObject, 0, o.flushCount)
 				}
 			}
-			outBytes = outBytes[:0]
-		case <-ticker:
-			if len(outBatch) > 0 {
-				// This will block until the other side is ready to accept
-				// this batch, freeing us to start on the next one.
-				o.batchChan <- outBatch
-				outBatch = <-o.backChan
-				count = 0
+			continue
+		}
+		dropped, spooled, err := o.overflow.Push(outBatch)
+		atomic.AddInt64(&o.stats.dropped, int64(dropped))
+		if spooled {
+			atomic.AddInt64(&o.stats.spooled, int64(len(outBatch)))
+		}
+		if err != nil {
+			o.logError(or, fmt.Errorf("Dropped %d messages: %s", dropped, err))
+		} else if dropped > 0 {
+			o.logError(or, fmt.Errorf("Overflow: dropped %d messages", dropped))
+		}
+		outBatches[i] = nil
+		if replace {
+			// Queued buffers come back later, if ever
+			select {
+			case outBatches[i] = <-o.backChan:
+			default:
+				outBatches[i] = make([]*RiakObject, 0, o.flushCount)
 			}
 		}
 	}
-	wg.Done()
 }
 
-// RiakCoordinates stores the coordinates (_index, _type, _id) of an Riak document
-type RiakCoordinates struct {
-	Index                string
-	Type                 string
-	Id                   string
-	Timestamp            *int64
-	TimestampFormat      string
-	RiakIndexFromTimestamp bool
+// Hands a batch over to a committer. The input channel is read meanwhile,
+// so that its closing starts the shutdown timeout even while the committers
+// are stuck. Returns false if the shutdown timeout expires first.
+func (o *RiakOutput) handOver(r *receiverState, i int, outBatch []*RiakObject) bool {
+	for {
+		select {
+		case o.batchChans[i] <- outBatch:
+			return true
+		case pack, ok := <-r.inChan:
+			if !ok {
+				o.inputClosed(r)
+				continue
+			}
+			r.pending = append(r.pending, pack)
+		case <-o.abandoned:
+			r.abandoned = true
+			return false
+		}
+	}
 }
 
-func (e *RiakCoordinates) String(m *message.Message) string {
-	return string(e.Bytes(m))
+// Runs in a separate goroutine when batches are queued, handing them over to
+// the committers in order. Closes the committer channels once the queue is
+// closed and empty.
+func (o *RiakOutput) dispatcher(or OutputRunner, wg *sync.WaitGroup) {
+	for {
+		outBatch, ok, err := o.overflow.Pop()
+		if err != nil {
+			o.logError(or, err)
+		}
+		if !ok {
+			break
+		}
+		if len(outBatch) > 0 {
+			o.tracker.Hold(outBatch)
+			o.batchChans[o.partition(outBatch[0])] <- outBatch
+		}
+	}
+	for _, batchChan := range o.batchChans {
+		close(batchChan)
+	}
+	wg.Done()
 }
 
-// Renders the coordinates of the Riak document as JSON
-func (e *RiakCoordinates) Bytes(m *message.Message) []byte {
-	buf := bytes.Buffer{}
-	buf.WriteString(`{"index":{"_index":`)
+// Returns the index of the channel of an object: the same one for all the
+// writes of a key when ordering by key, chunks going with their object
+func (o *RiakOutput) partition(obj *RiakObject) int {
+	if len(o.batchChans) == 1 {
+		return 0
+	}
+	key := obj.Key
+	if parent, ok := obj.UserMeta[metaChunkOf]; ok {
+		key = parent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(obj.BucketType + "/" + obj.Bucket + "/" + key))
+	return int(h.Sum32() % uint32(len(o.batchChans)))
+}
+
+// RiakCoordinates stores the coordinates (bucket type, bucket, key) of a Riak object
+type RiakCoordinates struct {
+	Index                  *template
+	Type                   *template
+	Id                     *template
+	Timestamp              *int64
+	RiakIndexFromTimestamp bool
+	// Encoding of interpolated bytes fields: "hex" (default) or "base64"
+	BytesEncoding string
+	// What missing fields interpolate to: "time" (default, the name is used
+	// as a time layout), "empty" or "error"
+	MissingField string
+	// Time zone of time layouts, if not the default one
+	Location *time.Location
+	// Fail when the bucket or bucket type can't be interpolated, rather than
+	// using the value they fell back to
+	Strict bool
+}
 
+// Builds an empty Riak object located at the interpolated coordinates.
+// Fails if strict and the bucket or bucket type can't be interpolated.
+func (e *RiakCoordinates) Object(m *message.Message) (obj *RiakObject, err error) {
 	var (
-		err         error
 		interpIndex string
 		interpType  string
 		interpId    string
 	)
 
-	interpIndex, err = interpolateFlag(e, m, e.Index)
-
-	buf.WriteString(strconv.Quote(interpIndex))
-	buf.WriteString(`,"_type":`)
+	if interpIndex, err = e.Index.Render(e, m); err != nil && e.Strict {
+		return nil, err
+	}
+	if interpType, err = e.Type.Render(e, m); err != nil && e.Strict {
+		return nil, err
+	}
 
-	interpType, err = interpolateFlag(e, m, e.Type)
-	buf.WriteString(strconv.Quote(interpType))
+	obj = &RiakObject{BucketType: interpType, Bucket: interpIndex}
 
 	//Interpolate the Id flag
-	interpId, err = interpolateFlag(e, m, e.Id)
+	interpId, err = e.Id.Render(e, m)
 
-	//Check that Id successfully interpolated. If not then do not specify id at all and default to auto-generated one.
-	if len(e.Id) > 0 && err == nil {
-		buf.WriteString(`,"_id":`)
-		buf.WriteString(strconv.Quote(interpId))
+	//Check that Id successfully interpolated. If not then do not specify id at all and let Riak generate one.
+	if !e.Id.Empty() && err == nil {
+		obj.Key = interpId
 	}
-	if e.Timestamp != nil {
-		t := time.Unix(0, *e.Timestamp)
-		buf.WriteString(`,"_timestamp":"`)
-		buf.WriteString(t.Format(e.TimestampFormat))
-		buf.WriteString(`"`)
+	return obj, nil
+}
+
+// A RiakObject is a value to be stored in Riak, along with its location
+type RiakObject struct {
+	BucketType string
+	Bucket     string
+	// Empty when Riak should generate the key
+	Key         string
+	ContentType string
+	// Content-Encoding of compressed values, if any
+	ContentEncoding string
+	Value           []byte
+	// User metadata, by lower case name, written as X-Riak-Meta-* headers
+	UserMeta map[string]string
+	// Query parameters of the write request
+	Options url.Values
+	// Uuid of the message, set when deduplicating
+	Uuid string
+	// Write only if the key doesn't exist yet
+	IfNoneMatch bool
+	// Severity of the message, the least severe messages are dropped first
+	Severity int32
+	// Written as Link headers
+	Links []RiakLink
+	// Other chunks of a split object, written before it
+	chunks []*RiakObject
+	// Read back from the spool
+	spooled bool
+}
+
+// A RiakLink is a link from an object to another, with a tag. Riak links
+// have no bucket type: Riak only parses and walks them in the default one.
+type RiakLink struct {
+	Bucket string
+	Key    string
+	Tag    string
+}
+
+// Returns the value of the Link header of the link
+func (l RiakLink) Header() string {
+	target := RiakObject{Bucket: l.Bucket, Key: l.Key}
+	return fmt.Sprintf("<%s>; riaktag=\"%s\"", target.Path(), url.QueryEscape(l.Tag))
+}
+
+// Sets a user metadata entry. Line breaks, which HTTP headers can't hold,
+// are replaced with spaces.
+func (r *RiakObject) SetMeta(name string, value string) {
+	if r.UserMeta == nil {
+		r.UserMeta = make(map[string]string)
 	}
-	buf.WriteString(`}}`)
-	return buf.Bytes()
+	r.UserMeta[strings.ToLower(name)] = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// Returns the HTTP resource the object is written to, with URL encoded names
+func (r *RiakObject) Path() string {
+	path := "/buckets/" + escapePath(r.Bucket) + "/keys"
+	if len(r.BucketType) > 0 {
+		path = "/types/" + escapePath(r.BucketType) + path
+	}
+	if len(r.Key) > 0 {
+		path += "/" + escapePath(r.Key)
+	}
+	return path
+}
+
+// URL encodes a name, including the commas Riak splits Link headers on
+func escapePath(name string) string {
+	return strings.Replace(url.PathEscape(name), ",", "%2C", -1)
 }
 
 // A Message Formatter formats a Heka message in JSON ([]byte)
 type MessageFormatter interface {
 	// Formats a Heka message in JSON
 	Format(*message.Message) (doc []byte, err error)
+	// Content type of the formatted documents
+	ContentType() string
 }
 
 // Raw message formatter leaves the Heka message untouched
@@ -256,6 +1016,10 @@ func (r *RawMessageFormatter) Format(m *message.Message) (doc []byte, err error)
 	return json.Marshal(m)
 }
 
+func (r *RawMessageFormatter) ContentType() string {
+	return "application/json"
+}
+
 // Payload message formatter just returns the contents of the message payload.
 type PayloadFormatter struct {
 }
@@ -264,12 +1028,65 @@ func (pf *PayloadFormatter) Format(m *message.Message) (doc []byte, err error) {
 	return []byte(m.GetPayload()), nil
 }
 
+func (pf *PayloadFormatter) ContentType() string {
+	return "text/plain"
+}
+
 // Clean message formatter reformats the Heka message in a more friendly way
 type CleanMessageFormatter struct {
 	// Field names to include in Riak document for "clean" format
 	fields          []string
 	timestampFormat string
 	rawBytesFields  []string
+	// Selects the dynamic fields to include, all of them when nil
+	fieldFilter *fieldFilter
+	// Where the representation of dynamic fields goes
+	representation int
+	// Whether dotted dynamic field names are expanded into nested objects
+	expandFieldNames   bool
+	fieldNameCollision int
+	// How the payload is parsed as JSON, and the policy on parse failures
+	payloadJSON      int
+	payloadJSONKey   string
+	payloadJSONError int
+}
+
+// Dynamic field representation modes
+const (
+	representationNone = iota
+	representationSibling
+	representationNested
+)
+
+// Expanded field name collision rules
+const (
+	collisionFlat = iota
+	collisionOverwrite
+	collisionValueKey
+	collisionError
+)
+
+// JSON payload modes and parse failure policies
+const (
+	payloadJSONNone = iota
+	payloadJSONMerge
+	payloadJSONNest
+)
+
+const (
+	payloadErrorKeep = iota
+	payloadErrorDrop
+	payloadErrorBucket
+)
+
+// A PayloadJSONError is returned along with the formatted document when the
+// payload isn't valid JSON and the document should go to the error bucket.
+type PayloadJSONError struct {
+	Err error
+}
+
+func (e *PayloadJSONError) Error() string {
+	return fmt.Sprintf("Unable to parse payload as JSON: %s", e.Err)
 }
 
 func NewCleanMessageFormatter(fields []string, timestampFormat string, rawBytesFields []string) *CleanMessageFormatter {
@@ -288,24 +1105,13 @@ func NewCleanMessageFormatter(fields []string, timestampFormat string, rawBytesF
 				"Fields",
 			},
 			timestampFormat: timestampFormat,
-			rawBytesFields: rawBytesFields,
+			rawBytesFields:  rawBytesFields,
 		}
 	} else {
 		return &CleanMessageFormatter{fields: fields, timestampFormat: timestampFormat, rawBytesFields: rawBytesFields}
 	}
 }
 
-// Append a field (with a name and a value) to a Buffer
-func writeField(b *bytes.Buffer, name string, value string) {
-	if b.Len() > 1 {
-		b.WriteString(`,`)
-	}
-	b.WriteString(`"`)
-	b.WriteString(name)
-	b.WriteString(`":`)
-	b.WriteString(value)
-}
-
 const lowerhex = "0123456789abcdef"
 
 func writeUTF16Escape(b *bytes.Buffer, c rune) {
@@ -384,62 +1190,67 @@ func writeRawField(first bool, b *bytes.Buffer, name string, value string) {
 }
 
 func (c *CleanMessageFormatter) Format(m *message.Message) (doc []byte, err error) {
+	return c.encode(m, writeDocument)
+}
+
+func (c *CleanMessageFormatter) ContentType() string {
+	return "application/json"
+}
+
+// Builds the document of the message and encodes it with write. Documents
+// with an invalid JSON payload going to the error bucket are encoded too,
+// and returned along with the *PayloadJSONError.
+func (c *CleanMessageFormatter) encode(m *message.Message, write func(*bytes.Buffer, document)) (doc []byte, err error) {
+	var d document
+	if d, err = c.document(m); err != nil {
+		if _, ok := err.(*PayloadJSONError); !ok {
+			return
+		}
+	}
 	buf := bytes.Buffer{}
-	buf.WriteString(`{`)
+	write(&buf, d)
+	doc = buf.Bytes()
+	return
+}
+
+// Builds the document holding the fields configured for clean formatting
+func (c *CleanMessageFormatter) document(m *message.Message) (d document, err error) {
+	var payloadErr error
 	// Iterates over fields configured for clean formating
 	for _, f := range c.fields {
 		switch strings.ToLower(f) {
 		case "uuid":
-			writeField(&buf, f, strconv.Quote(m.GetUuidString()))
+			d.add(f, m.GetUuidString())
 		case "timestamp":
 			t := time.Unix(0, m.GetTimestamp()).UTC()
-			writeField(&buf, f, strconv.Quote(t.Format(c.timestampFormat)))
+			d.add(f, t.Format(c.timestampFormat))
 		case "type":
-			writeField(&buf, f, strconv.Quote(m.GetType()))
+			d.add(f, m.GetType())
 		case "logger":
-			writeField(&buf, f, strconv.Quote(m.GetLogger()))
+			d.add(f, m.GetLogger())
 		case "severity":
-			writeField(&buf, f, strconv.Itoa(int(m.GetSeverity())))
+			d.add(f, int64(m.GetSeverity()))
 		case "payload":
-			if utf8.ValidString(m.GetPayload()) {
-				writeField(&buf, f, strconv.Quote(m.GetPayload()))
+			if payloadErr = c.addPayload(&d, f, m.GetPayload()); payloadErr != nil {
+				if _, ok := payloadErr.(*PayloadJSONError); !ok {
+					err = payloadErr
+					return
+				}
 			}
 		case "envversion":
-			writeField(&buf, f, strconv.Quote(m.GetEnvVersion()))
+			d.add(f, m.GetEnvVersion())
 		case "pid":
-			writeField(&buf, f, strconv.Itoa(int(m.GetPid())))
+			d.add(f, int64(m.GetPid()))
 		case "hostname":
-			writeField(&buf, f, strconv.Quote(m.GetHostname()))
+			d.add(f, m.GetHostname())
 		case "fields":
-                        raw := false
 			for _, field := range m.Fields {
-                                if len(c.rawBytesFields) > 0 {
-                                        for _, raw_field_name := range c.rawBytesFields {
-                                                if *field.Name == raw_field_name {
-                                                        raw = true
-                                                }
-                                        }
-                                }
-                                if raw {
-                                        data := field.GetValue().([]byte)[:]
-                                        writeField(&buf, *field.Name, string(data))
-                                        raw = false
-                                } else {
-                                        switch field.GetValueType() {
-                                        case message.Field_STRING:
-                                                writeField(&buf, *field.Name, strconv.Quote(field.GetValue().(string)))
-                                        case message.Field_BYTES:
-                                                data := field.GetValue().([]byte)[:]
-                                                writeField(&buf, *field.Name, strconv.Quote(base64.StdEncoding.EncodeToString(data)))
-                                        case message.Field_INTEGER:
-                                                writeField(&buf, *field.Name, strconv.FormatInt(field.GetValue().(int64), 10))
-                                        case message.Field_DOUBLE:
-                                                writeField(&buf, *field.Name, strconv.FormatFloat(field.GetValue().(float64),
-                                                        'g', -1, 64))
-                                        case message.Field_BOOL:
-                                                writeField(&buf, *field.Name, strconv.FormatBool(field.GetValue().(bool)))
-                                        }
-                                }
+				if c.fieldFilter != nil && !c.fieldFilter.Match(field.GetName()) {
+					continue
+				}
+				if err = c.addField(&d, field); err != nil {
+					return
+				}
 			}
 		default:
 			// Search fo a given fields in the message
@@ -447,123 +1258,350 @@ func (c *CleanMessageFormatter) Format(m *message.Message) (doc []byte, err erro
 			return
 		}
 	}
-	buf.WriteString(`}`)
-	doc = buf.Bytes()
+	err = payloadErr
+	return
+}
+
+// Adds the payload, as a string or parsed as JSON
+func (c *CleanMessageFormatter) addPayload(d *document, name string, payload string) error {
+	if c.payloadJSON != payloadJSONNone {
+		value, err := parseJSON([]byte(payload))
+		if err == nil {
+			if c.payloadJSON == payloadJSONNest {
+				d.add(c.payloadJSONKey, value)
+				return nil
+			}
+			if object, ok := value.(document); ok {
+				for _, field := range object {
+					if i := d.index(field.name); i >= 0 {
+						(*d)[i].value = field.value
+					} else {
+						d.add(field.name, field.value)
+					}
+				}
+				return nil
+			}
+			err = errors.New("payload is not a JSON object")
+		}
+		switch c.payloadJSONError {
+		case payloadErrorDrop:
+			return fmt.Errorf("Unable to parse payload as JSON: %s", err)
+		case payloadErrorBucket:
+			if utf8.ValidString(payload) {
+				d.add(name, payload)
+			}
+			return &PayloadJSONError{err}
+		}
+	}
+	if utf8.ValidString(payload) {
+		d.add(name, payload)
+	}
+	return nil
+}
+
+// Adds a dynamic field, as an array when it holds several values, along
+// with its representation
+func (c *CleanMessageFormatter) addField(d *document, field *message.Field) (err error) {
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		raw := c.isRawBytesField(field.GetName())
+		for _, v := range field.GetValueBytes() {
+			if raw {
+				values = append(values, rawValue(v))
+			} else {
+				values = append(values, v)
+			}
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, v)
+		}
+	}
+
+	var value interface{} = values
+	if len(values) == 1 {
+		value = values[0]
+	}
+	representation := field.GetRepresentation()
+	switch {
+	case len(representation) == 0 || c.representation == representationNone:
+		err = c.put(d, field.GetName(), value)
+	case c.representation == representationSibling:
+		if err = c.put(d, field.GetName(), value); err == nil {
+			err = c.put(d, field.GetName()+"_representation", representation)
+		}
+	case c.representation == representationNested:
+		err = c.put(d, field.GetName(), document{{"value", value}, {"representation", representation}})
+	}
+	return
+}
+
+// Adds a dynamic field value, expanding its name if configured to
+func (c *CleanMessageFormatter) put(d *document, name string, value interface{}) error {
+	if !c.expandFieldNames {
+		d.add(name, value)
+		return nil
+	}
+	if !d.insert(strings.Split(name, "."), value, c.fieldNameCollision) {
+		if c.fieldNameCollision == collisionError {
+			return fmt.Errorf("Field name %s collides with another field", name)
+		}
+		d.add(name, value)
+	}
+	return nil
+}
+
+func (c *CleanMessageFormatter) isRawBytesField(name string) bool {
+	for _, raw_field_name := range c.rawBytesFields {
+		if name == raw_field_name {
+			return true
+		}
+	}
+	return false
+}
+
+// Performs the actual task of extracting data from the pack and building
+// the Riak object to be written.
+func (o *RiakOutput) handleMessage(pack *PipelinePack) (obj *RiakObject, err error) {
+	defer pack.Recycle()
+	msg := pack.Message
+	if msg.GetType() == statsMessageType && msg.GetLogger() == o.pluginName {
+		// Stats of the output, matched by its message_matcher
+		return nil, nil
+	}
+	if o.dedupCache != nil && o.dedupCache.Contains(msg.GetUuidString()) {
+		// Already written
+		return nil, nil
+	}
+	if o.transformer != nil {
+		msg = o.transformer.Transform(msg)
+	}
+	if obj, err = o.buildObject(msg); err != nil && len(o.deadLetterBucket) > 0 {
+		// The error is still reported, along with the dead letter
+		var deadErr error
+		if obj, deadErr = o.deadLetter(msg, err); deadErr != nil {
+			err = fmt.Errorf("%s, and dead letter failed: %s", err, deadErr)
+		}
+	}
+	if err == nil && obj != nil {
+		atomic.AddInt64(&o.stats.formatted, 1)
+	}
+	if obj != nil {
+		obj.Severity = msg.GetSeverity()
+	}
 	return
 }
 
-// Performs the actual task of extracting data from the pack and writing it
-// into the output buffer.
-func (o *RiakOutput) handleMessage(pack *PipelinePack, outBytes *[]byte) (err error) {
+// Formats the message and builds the Riak object it is stored in
+func (o *RiakOutput) buildObject(msg *message.Message) (obj *RiakObject, err error) {
+	if obj, err = o.formatObject(msg); err != nil || obj == nil {
+		return
+	}
+	if o.maxObjectSize > 0 && len(obj.Value) > o.maxObjectSize {
+		return o.oversized(msg, obj)
+	}
+	return
+}
 
-	// Builds Riak document coordinates (1st line of bulk indexing)
+// Builds the object of the message, whatever its size
+func (o *RiakOutput) formatObject(msg *message.Message) (obj *RiakObject, err error) {
+	r := o.route(msg)
+
+	// Builds Riak object coordinates
 	coordinates := &RiakCoordinates{
-		Index:                o.indexName,
-		Type:                 o.typeName,
-		Timestamp:            pack.Message.Timestamp,
-		TimestampFormat:      o.timestamp,
+		Index:                  r.index,
+		Type:                   r.typeName,
+		Timestamp:              msg.Timestamp,
 		RiakIndexFromTimestamp: o.riakIndexFromTimestamp,
-		Id:                   o.id,
+		Id:                     r.id,
+		BytesEncoding:          o.interpolateBytes,
+		MissingField:           o.interpolateMissing,
+		Location:               o.location,
+		// Messages which can't be located go to the dead letter bucket
+		Strict: len(o.deadLetterBucket) > 0 || o.interpolateMissing == "error",
 	}
 
 	var document []byte
-	document, err = o.messageFormatter.Format(pack.Message)
+	document, err = r.formatter.Format(msg)
+	if _, ok := err.(*PayloadJSONError); ok {
+		// Still stored, in the error bucket
+		coordinates.Index = o.payloadErrorBucket
+		err = nil
+	}
 	if err != nil {
-		pack.Recycle()
-		err = fmt.Errorf("Error in message conversion to %s format: %s", o.format, err)
+		err = fmt.Errorf("Error in message conversion to %s format: %s", r.format, err)
 		return
 	}
 
-	// Write new bulk lines
-	*outBytes = append(*outBytes, coordinates.Bytes(pack.Message)...)
-	*outBytes = append(*outBytes, NEWLINE)
-	*outBytes = append(*outBytes, document...)
-	*outBytes = append(*outBytes, NEWLINE)
+	if obj, err = coordinates.Object(msg); err != nil {
+		return nil, err
+	}
+	o.ttl.Apply(obj, r, msg)
+	if r.keyStrategy != keyTemplate {
+		obj.Key = generateKey(r.keyStrategy, msg, document)
+	}
+	if len(obj.Key) == 0 && o.cipher != nil {
+		// Encrypted values are bound to their key
+		obj.Key = msg.GetUuidString()
+	}
+	if err = o.sanitizer.SanitizeObject(obj); err != nil {
+		return nil, err
+	}
+	if err = o.addLinks(obj, r, coordinates, msg); err != nil {
+		return nil, err
+	}
+	// Template keys, like "%{Hostname}-latest", may be meant to be
+	// overwritten
+	if o.dedupCache != nil && r.keyStrategy != keyTemplate {
+		obj.Uuid = msg.GetUuidString()
+		obj.IfNoneMatch = true
+	}
+	obj.ContentType = r.formatter.ContentType()
+	obj.Value = document
+	obj.Options = r.options
+	obj.Severity = msg.GetSeverity()
+	if err = o.seal(obj); err != nil {
+		return nil, err
+	}
+	return
+}
 
-	document = document[:0]
-	pack.Recycle()
+// Compresses and encrypts the value of the object, as configured
+func (o *RiakOutput) seal(obj *RiakObject) (err error) {
+	if o.compressor != nil {
+		if err = o.compressor.Compress(obj); err != nil {
+			return
+		}
+	}
+	if o.cipher != nil {
+		err = o.cipher.Seal(obj)
+	}
 	return
 }
 
-// Runs in a separate goroutine, waits for buffered data on the committer
-// channel, bulk index it out to the Riak cluster, and puts the now empty buffer on
-// the return channel for reuse.
-func (o *RiakOutput) committer(wg *sync.WaitGroup) {
-	initBatch := make([]byte, 0, 10000)
-	o.backChan <- initBatch
-	var outBatch []byte
+// Returns the first route matching the message
+func (o *RiakOutput) route(m *message.Message) *riakRoute {
+	for _, r := range o.routes {
+		if r.Match(m) {
+			return r
+		}
+	}
+	// Never reached, the default route matches every message
+	return o.routes[len(o.routes)-1]
+}
 
-	for outBatch = range o.batchChan {
-		o.bulkIndexer.Index(outBatch)
-		outBatch = outBatch[:0]
-		o.backChan <- outBatch
+// Runs in a separate goroutine, waits for buffered objects on the committer
+// channel, writes them out to the Riak cluster, and puts the now empty buffer on
+// the return channel for reuse. Returns once the channel is closed and every
+// batch on it is written.
+func (o *RiakOutput) committer(or OutputRunner, wg *sync.WaitGroup, n int) {
+	o.recycle(make([]*RiakObject, 0, o.flushCount))
+	var outBatch []*RiakObject
+	bulkIndexer := o.bulkIndexers[n]
+
+	for outBatch = range o.batchChans[n%len(o.batchChans)] {
+		o.tracker.Hold(outBatch)
+		start := time.Now()
+		atomic.AddInt64(&o.stats.inFlight, 1)
+		o.batchSizes.Add(int64(len(outBatch)))
+		_, err := bulkIndexer.Index(outBatch)
+		atomic.AddInt64(&o.stats.inFlight, -1)
+		if o.adaptiveFlush != nil {
+			o.adaptiveFlush.Observe(time.Since(start), err != nil)
+		}
+		switch {
+		case err == errClusterOpen && o.breakerSpool:
+			o.spoolBatch(or, outBatch)
+		case err == errClusterOpen:
+			atomic.AddInt64(&o.stats.dropped, int64(len(outBatch)))
+			o.logError(or, fmt.Errorf("Dropped %d messages: %s", len(outBatch), err))
+		case err != nil:
+			o.logError(or, err)
+		case o.dedupCache != nil:
+			o.dedupCache.AddObjects(outBatch)
+		}
+		o.tracker.Release(outBatch)
+		o.recycle(outBatch[:0])
 	}
 	wg.Done()
 }
 
+// Spools a batch while the cluster is down, then waits for the breaker to
+// probe the cluster rather than going through the batches spooled meanwhile,
+// unless shutting down
+func (o *RiakOutput) spoolBatch(or OutputRunner, outBatch []*RiakObject) {
+	if err := o.overflow.Spool(outBatch); err != nil {
+		atomic.AddInt64(&o.stats.dropped, int64(len(outBatch)))
+		o.logError(or, fmt.Errorf("Dropped %d messages: %s", len(outBatch), err))
+		return
+	}
+	o.countSpooled(outBatch)
+	select {
+	case <-time.After(o.clusterBreaker.Remaining()):
+	case <-o.stopping:
+	}
+}
+
+// Counts the messages of a spooled batch, unless it was read back from the
+// spool and already counted
+func (o *RiakOutput) countSpooled(outBatch []*RiakObject) {
+	if len(outBatch) > 0 && !outBatch[0].spooled {
+		atomic.AddInt64(&o.stats.spooled, int64(len(outBatch)))
+	}
+}
+
+// Puts an empty buffer back in the pool. When batches are queued, the pool
+// may be full of buffers allocated meanwhile, and the buffer is dropped.
+func (o *RiakOutput) recycle(outBatch []*RiakObject) {
+	select {
+	case o.backChan <- outBatch:
+	default:
+	}
+}
+
 // Replaces a date pattern (ex: %{2012.09.19}) in the index name
 func interpolateFlag(e *RiakCoordinates, m *message.Message, name string) (interpolatedValue string, err error) {
-	iSlice := strings.Split(name, "%{")
-	var t time.Time
-
-	for i, element := range iSlice {
-		elEnd := strings.Index(element, "}")
-
-		if elEnd > -1 {
-			elVal := element[:elEnd]
-			switch elVal {
-			case "Type":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], m.GetType(), -1)
-			case "Hostname":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], m.GetHostname(), -1)
-			case "Pid":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], strconv.Itoa(int(m.GetPid())), -1)
-			case "UUID":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], m.GetUuidString(), -1)
-			case "Logger":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], m.GetLogger(), -1)
-			case "EnvVersion":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], m.GetEnvVersion(), -1)
-			case "Severity":
-				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], strconv.Itoa(int(m.GetSeverity())), -1)
-			default:
-				if fname, ok := m.GetFieldValue(elVal); ok {
-					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], fname.(string), -1)
-				} else {
-					if e.RiakIndexFromTimestamp && e.Timestamp != nil {
-						t = time.Unix(0, *e.Timestamp).UTC()
-					} else {
-						t = time.Now()
-					}
-					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], t.Format(elVal), -1)
-				}
-			}
-			if iSlice[i] == elVal {
-				err = fmt.Errorf("Could not interpolate field from config: %s", name)
-			}
-		}
+	var t *template
+	if t, err = compileTemplate(name); err != nil {
+		return
 	}
-	interpolatedValue = strings.Join(iSlice, "")
-	return
+	return t.Render(e, m)
 }
 
-// A BulkIndexer is used to index documents in Riak
+// A BulkIndexer is used to store batches of objects in Riak
 type BulkIndexer interface {
-	// Index documents
-	Index(body []byte) (success bool, err error)
+	// Store objects
+	Index(objects []*RiakObject) (success bool, err error)
 	// Check if a flush is needed
 	CheckFlush(count int, length int) bool
 }
 
 // A HttpBulkIndexer uses the HTTP Api for Riak
-// in order to index documents
+// in order to store objects
 type HttpBulkIndexer struct {
 	// Protocol (http or https)
 	Protocol string
-	// Host name and port number (default to "localhost:8087")
+	// Host name and port number (default to "localhost:8098")
 	Domain string
 	// Maximum number of documents
 	MaxCount int
+	// Maximum size of the stored values, 0 for none
+	MaxBytes int
+	// Adapts the maximum number of documents, if set
+	adaptive *adaptiveFlush
 	// Internal HTTP Client
 	clientConn *httputil.ClientConn
 	// TCP Connection for HTTP client
@@ -577,25 +1615,70 @@ func NewHttpBulkIndexer(protocol string, domain string, maxCount int, http_timeo
 }
 
 func (h *HttpBulkIndexer) CheckFlush(count int, length int) bool {
-	if count >= h.MaxCount {
+	maxCount := h.MaxCount
+	if h.adaptive != nil {
+		maxCount = h.adaptive.Count()
+	}
+	if count >= maxCount {
+		return true
+	}
+	if h.MaxBytes > 0 && length >= h.MaxBytes {
 		return true
 	}
 	return false
 }
 
-func (h *HttpBulkIndexer) Index(body []byte) (success bool, err error) {
+// Stores the objects one at a time. Objects rejected by the node don't stop
+// the batch: the last rejection is returned after the others are stored.
+func (h *HttpBulkIndexer) Index(objects []*RiakObject) (success bool, err error) {
+	var rejected error
+	for _, obj := range objects {
+		if err = h.store(obj); err != nil && nodeFailure(err) {
+			return false, err
+		}
+		if err != nil {
+			rejected = err
+		}
+	}
+	return rejected == nil, rejected
+}
+
+// Stores a single object, letting Riak generate its key if it has none
+func (h *HttpBulkIndexer) store(obj *RiakObject) (err error) {
 	if h.clientConn == nil {
-		h.tcpConn, _ = net.Dial("tcp", h.Domain)
+		if h.tcpConn, err = net.Dial("tcp", h.Domain); err != nil {
+			err = fmt.Errorf("Unable to connect to %s: %s", h.Domain, err)
+			return err
+		}
 		h.clientConn = httputil.NewClientConn(h.tcpConn, nil)
 	}
-	url := fmt.Sprintf("%s://%s%s", h.Protocol, h.Domain, "/_bulk")
+	url := fmt.Sprintf("%s://%s%s", h.Protocol, h.Domain, obj.Path())
+	if len(obj.Options) > 0 {
+		url += "?" + obj.Options.Encode()
+	}
+	method := "PUT"
+	if len(obj.Key) == 0 {
+		method = "POST"
+	}
 
-	// Creating Riak Bulk HTTP request
-	if request, err := http.NewRequest("POST", url, bytes.NewReader(body)); err != nil {
-		err = fmt.Errorf("Error creating bulk request: %s", err)
-		return false, err
+	// Creating Riak store HTTP request
+	if request, err := http.NewRequest(method, url, bytes.NewReader(obj.Value)); err != nil {
+		err = fmt.Errorf("Error creating store request: %s", err)
+		return err
 	} else {
-		request.Header.Add("Accept", "application/json")
+		request.Header.Add("Content-Type", obj.ContentType)
+		if len(obj.ContentEncoding) > 0 {
+			request.Header.Add("Content-Encoding", obj.ContentEncoding)
+		}
+		for name, value := range obj.UserMeta {
+			request.Header.Add("X-Riak-Meta-"+name, value)
+		}
+		if obj.IfNoneMatch {
+			request.Header.Add("If-None-Match", "*")
+		}
+		for _, link := range obj.Links {
+			request.Header.Add("Link", link.Header())
+		}
 		if h.HTTPTimeout != 0 {
 			h.tcpConn.SetDeadline(time.Now().Add(time.Duration(h.HTTPTimeout) * time.Millisecond))
 		}
@@ -605,27 +1688,32 @@ func (h *HttpBulkIndexer) Index(body []byte) (success bool, err error) {
 			//Post timed out. Close connection.
 			h.clientConn.Close()
 			h.clientConn = nil
-			err = fmt.Errorf("Bulk post connection has timed out: %s", err)
-			return false, err
-		} 
- 
+			err = fmt.Errorf("Store connection has timed out: %s", err)
+			return err
+		}
+
 		if err != nil {
-			err = fmt.Errorf("Error executing bulk request: %s", err)
-			return false, err
+			// The connection may be broken, the next store reconnects
+			h.clientConn.Close()
+			h.clientConn = nil
+			err = fmt.Errorf("Error executing store request: %s", err)
+			return err
 		}
 		if response != nil {
 			defer response.Body.Close()
-			if response.StatusCode > 304 {
-				err = fmt.Errorf("Bulk response in error: %s", response.Status)
-				return false, err
+			// With If-None-Match, a failed precondition means already stored
+			stored := response.StatusCode == http.StatusPreconditionFailed && obj.IfNoneMatch
+			if response.StatusCode > 304 && !stored {
+				ioutil.ReadAll(response.Body)
+				return &StatusError{Code: response.StatusCode, Status: response.Status}
 			}
 			if _, err = ioutil.ReadAll(response.Body); err != nil {
-				err = fmt.Errorf("Bulk bulk response reading in error: %s", err)
-				return false, err
+				err = fmt.Errorf("Store response reading in error: %s", err)
+				return err
 			}
 		}
 	}
-	return true, nil
+	return nil
 }
 
 func init() {
@@ -3,10 +3,17 @@ package riak
 import (
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
-	//"encoding/json"
+	"encoding/json"
+	"fmt"
 	. "github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -45,6 +52,98 @@ func getTestMessageWithFunnyFields() *Message {
 	return msg
 }
 
+// Records the keys of the objects it indexes, by indexer
+type recordingIndexer struct {
+	lock *sync.Mutex
+	keys map[int][]string
+	n    int
+}
+
+func (r *recordingIndexer) Index(objects []*RiakObject) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, obj := range objects {
+		r.keys[r.n] = append(r.keys[r.n], obj.Key)
+	}
+	return true, nil
+}
+
+func (r *recordingIndexer) CheckFlush(count int, length int) bool {
+	return false
+}
+
+// Never returns until released, like a write to a hung node
+type stuckIndexer struct {
+	release chan struct{}
+}
+
+func (s *stuckIndexer) Index(objects []*RiakObject) (bool, error) {
+	<-s.release
+	return true, nil
+}
+
+func (s *stuckIndexer) CheckFlush(count int, length int) bool {
+	return count >= 1
+}
+
+// Feeds the output through its own channel, recording the errors it logs
+type testOutputRunner struct {
+	pipeline.OutputRunner
+	inChan   chan *pipeline.PipelinePack
+	lock     sync.Mutex
+	errors   []string
+	injected []*pipeline.PipelinePack
+}
+
+func (r *testOutputRunner) InChan() chan *pipeline.PipelinePack {
+	return r.inChan
+}
+
+func (r *testOutputRunner) Name() string {
+	return "RiakOutput"
+}
+
+func (r *testOutputRunner) LogError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors = append(r.errors, err.Error())
+}
+
+func (r *testOutputRunner) LogMessage(msg string) {
+}
+
+func (r *testOutputRunner) Inject(pack *pipeline.PipelinePack) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.injected = append(r.injected, pack)
+	return true
+}
+
+// Hands out the packs of its pool, blocking while it is empty
+type testPluginHelper struct {
+	pipeline.PluginHelper
+	packs chan *pipeline.PipelinePack
+}
+
+func (h *testPluginHelper) PipelinePack(msgLoopCount uint) *pipeline.PipelinePack {
+	return <-h.packs
+}
+
+// Returns a batch of objects of 10 bytes, with their keys and severities
+func getTestBatch(keys string, severities ...int32) (batch []*RiakObject) {
+	for i, severity := range severities {
+		batch = append(batch, &RiakObject{Key: keys[i : i+1], Value: make([]byte, 10), Severity: severity})
+	}
+	return
+}
+
+func batchKeys(batch []*RiakObject) (keys string) {
+	for _, obj := range batch {
+		keys += obj.Key
+	}
+	return
+}
+
 func RiakOutputSpec(c gs.Context) {
 	c.Specify("Should properly encode special characters in json", func() {
 		buf := bytes.Buffer{}
@@ -69,6 +168,1332 @@ func RiakOutputSpec(c gs.Context) {
 		c.Expect(string(b), gs.Equals, jsonPayload)
 	})
 
+	c.Specify("Should properly encode message using clean formatter", func() {
+		formatter := NewCleanMessageFormatter([]string{"Type", "Severity", "Hostname"},
+			"2006-01-02T15:04:05.000Z", nil)
+		b, err := formatter.Format(getTestMessageWithFunnyFields())
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"Type":"TEST","Severity":6,"Hostname":"hostname"}`)
+	})
+
+	c.Specify("Should encode message fields using msgpack and cbor formatters", func() {
+		clean := NewCleanMessageFormatter([]string{"Type", "Severity", "Fields"},
+			"2006-01-02T15:04:05.000Z", nil)
+		expected := map[string]interface{}{
+			"Type":     "TEST",
+			"Severity": int64(6),
+			`"foo`:     "bar\n",
+			`"number`:  int64(64),
+			"\xa3":     "\xa3",
+			"idField":  "1234",
+		}
+
+		b, err := NewMsgpackMessageFormatter(clean).Format(getTestMessageWithFunnyFields())
+		c.Expect(err, gs.IsNil)
+		decoded, err := DecodeMsgpack(b)
+		c.Expect(err, gs.IsNil)
+		c.Expect(decoded, gs.Equals, expected)
+
+		b, err = NewCborMessageFormatter(clean).Format(getTestMessageWithFunnyFields())
+		c.Expect(err, gs.IsNil)
+		decoded, err = DecodeCbor(b)
+		c.Expect(err, gs.IsNil)
+		c.Expect(decoded, gs.Equals, expected)
+	})
+
+	c.Specify("Should decode binary integers, floats and nested values", func() {
+		value := []interface{}{int64(-33), int64(300), int64(-70000), int64(1) << 40,
+			1.5, true, nil, []byte{1, 2}, map[string]interface{}{"a": []interface{}{"b"}}}
+		for _, enc := range []struct {
+			write  func(*bytes.Buffer, interface{})
+			decode func([]byte) (interface{}, error)
+		}{{writeMsgpack, DecodeMsgpack}, {writeCbor, DecodeCbor}} {
+			buf := bytes.Buffer{}
+			enc.write(&buf, value)
+			decoded, err := enc.decode(buf.Bytes())
+			c.Expect(err, gs.IsNil)
+			c.Expect(decoded, gs.Equals, value)
+		}
+	})
+
+	c.Specify("Should encode multi-value fields and their representation", func() {
+		msg := getTestMessageWithFunnyFields()
+		tags, _ := NewField("tags", "a", "")
+		tags.AddValue("b")
+		latency, _ := NewField("latency", 12.5, "ms")
+		msg.Fields = []*Field{tags, latency}
+		formatter := NewCleanMessageFormatter([]string{"Fields"}, "", nil)
+
+		b, err := formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"tags":["a","b"],"latency":12.5}`)
+
+		formatter.representation = representationSibling
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals,
+			`{"tags":["a","b"],"latency":12.5,"latency_representation":"ms"}`)
+
+		formatter.representation = representationNested
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals,
+			`{"tags":["a","b"],"latency":{"value":12.5,"representation":"ms"}}`)
+	})
+
+	c.Specify("Should expand dotted field names into nested objects", func() {
+		msg := getTestMessageWithFunnyFields()
+		method, _ := NewField("http.request.method", "GET", "")
+		status, _ := NewField("http.status", 200, "")
+		http, _ := NewField("http", "scalar", "")
+		msg.Fields = []*Field{method, status, http}
+		formatter := NewCleanMessageFormatter([]string{"Fields"}, "", nil)
+		formatter.expandFieldNames = true
+
+		formatter.fieldNameCollision = collisionValueKey
+		b, err := formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals,
+			`{"http":{"request":{"method":"GET"},"status":200,"_value":"scalar"}}`)
+
+		msg.Fields = []*Field{http, method, status}
+		formatter.fieldNameCollision = collisionFlat
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals,
+			`{"http":"scalar","http.request.method":"GET","http.status":200}`)
+
+		formatter.fieldNameCollision = collisionOverwrite
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"http":{"request":{"method":"GET"},"status":200}}`)
+
+		formatter.fieldNameCollision = collisionError
+		_, err = formatter.Format(msg)
+		c.Expect(err.Error(), gs.Equals, "Field name http.request.method collides with another field")
+	})
+
+	c.Specify("Should merge or nest JSON payloads", func() {
+		msg := getTestMessageWithFunnyFields()
+		msg.SetPayload(`{"status": 200, "tags": ["a"], "Type": "access"}`)
+		formatter := NewCleanMessageFormatter([]string{"Type", "Payload"}, "", nil)
+
+		formatter.payloadJSON = payloadJSONMerge
+		b, err := formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"Type":"access","status":200,"tags":["a"]}`)
+
+		formatter.payloadJSON = payloadJSONNest
+		formatter.payloadJSONKey = "doc"
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals,
+			`{"Type":"TEST","doc":{"status":200,"tags":["a"],"Type":"access"}}`)
+
+		// Keys and strings of payloads are escaped as JSON
+		msg.SetPayload(`{"a\"b": "\u0001\u0007\u000b"}`)
+		formatter.payloadJSON = payloadJSONMerge
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"Type":"TEST","a\u0022b":"\u0001\u0007\u000b"}`)
+		var decoded map[string]string
+		c.Expect(json.Unmarshal(b, &decoded), gs.IsNil)
+		c.Expect(decoded["a\"b"], gs.Equals, "\x01\a\v")
+	})
+
+	c.Specify("Should apply the policy on invalid JSON payloads", func() {
+		msg := getTestMessageWithFunnyFields()
+		formatter := NewCleanMessageFormatter([]string{"Type", "Payload"}, "", nil)
+		formatter.payloadJSON = payloadJSONMerge
+
+		b, err := formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"Type":"TEST","Payload":"Test Payload"}`)
+
+		formatter.payloadJSONError = payloadErrorDrop
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(b, gs.IsNil)
+
+		formatter.payloadJSONError = payloadErrorBucket
+		b, err = formatter.Format(msg)
+		_, ok := err.(*PayloadJSONError)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(string(b), gs.Equals, `{"Type":"TEST","Payload":"Test Payload"}`)
+	})
+
+	c.Specify("Should include and exclude dynamic fields by pattern", func() {
+		msg := getTestMessageWithFunnyFields()
+		for _, name := range []string{"db_password", "debug.trace", "debugger", "user"} {
+			field, _ := NewField(name, "x", "")
+			msg.AddField(field)
+		}
+		formatter := NewCleanMessageFormatter([]string{"Fields"}, "", nil)
+
+		var err error
+		formatter.fieldFilter, err = newFieldFilter(nil, []string{"*_password", "debug.*", "re:^[^a-z]"})
+		c.Expect(err, gs.IsNil)
+		b, err := formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"idField":"1234","debugger":"x","user":"x"}`)
+
+		formatter.fieldFilter, err = newFieldFilter([]string{"debug*", "re:Field$"}, []string{"debugger"})
+		c.Expect(err, gs.IsNil)
+		b, err = formatter.Format(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(b), gs.Equals, `{"idField":"1234","debug.trace":"x"}`)
+
+		_, err = newFieldFilter([]string{"re:("}, nil)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Should redact, hash and truncate fields and payload", func() {
+		msg := getTestMessageWithFunnyFields()
+		msg.SetPayload("mail john@example.com from 10.0.0.1")
+		transformer, err := newMessageTransformer([]TransformConfig{
+			{Name: "email", Payload: true, Action: "redact", Pattern: `[\w.]+@[\w.]+`},
+			{Payload: true, Action: "hmac", Pattern: `\d+\.\d+\.\d+\.\d+`, Salt: "s"},
+			{Fields: []string{"id*"}, Action: "truncate", Length: 2},
+		})
+		c.Expect(err, gs.IsNil)
+
+		transformed := transformer.Transform(msg)
+		c.Expect(transformed.GetPayload(), gs.Equals,
+			"mail [REDACTED] from a2c4b1f0de8150fc7107957423b16f3ed73a50ff3e721161245b36b0af8a18c9")
+		value, _ := transformed.GetFieldValue("idField")
+		c.Expect(value, gs.Equals, "12")
+		c.Expect(transformer.rules[0].Hits(), gs.Equals, int64(1))
+		c.Expect(transformer.rules[2].Hits(), gs.Equals, int64(1))
+
+		// The original message is left untouched
+		c.Expect(msg.GetPayload(), gs.Equals, "mail john@example.com from 10.0.0.1")
+		value, _ = msg.GetFieldValue("idField")
+		c.Expect(value, gs.Equals, "1234")
+
+		// The hits of each rule are reported
+		output := &RiakOutput{stats: new(riakStats), transformer: transformer}
+		report := &Message{}
+		c.Expect(output.ReportMsg(report), gs.IsNil)
+		for name, expected := range map[string]int64{
+			"email-HitCount":         1,
+			"transforms[1]-HitCount": 1,
+			"transforms[2]-HitCount": 1,
+		} {
+			value, _ = report.GetFieldValue(name)
+			c.Expect(value, gs.Equals, expected)
+		}
+	})
+
+	c.Specify("Should transform bytes fields as strings", func() {
+		msg := getTestMessageWithFunnyFields()
+		field, _ := NewField("token", []byte("auth token=xyz"), "")
+		msg.AddField(field)
+		field, _ = NewField("blob", []byte{0xff, 0xfe, 0x01}, "")
+		msg.AddField(field)
+		transformer, err := newMessageTransformer([]TransformConfig{
+			{Fields: []string{"token"}, Action: "redact", Pattern: `token=\w+`},
+			{Fields: []string{"blob"}, Action: "truncate", Length: 2},
+		})
+		c.Expect(err, gs.IsNil)
+
+		transformed := transformer.Transform(msg)
+		value, _ := transformed.GetFieldValue("token")
+		c.Expect(value, gs.Equals, []byte("auth [REDACTED]"))
+		value, _ = transformed.GetFieldValue("blob")
+		c.Expect(value, gs.Equals, []byte{0xff, 0xfe})
+		c.Expect(transformer.rules[0].Hits(), gs.Equals, int64(1))
+		value, _ = msg.GetFieldValue("token")
+		c.Expect(value, gs.Equals, []byte("auth token=xyz"))
+	})
+
+	c.Specify("Should encrypt values and decrypt them with the key ring", func() {
+		key := []byte("0123456789abcdef0123456789abcdef")
+		cipher, err := newEnvelopeCipher("k1", key)
+		c.Expect(err, gs.IsNil)
+		obj := &RiakObject{Bucket: "logs", ContentType: "application/json", Value: []byte(`{"a":1}`)}
+		err = cipher.Seal(obj)
+		c.Expect(err.Error(), gs.Equals, "Encrypted objects need a key")
+
+		obj.Key = "a"
+		c.Expect(cipher.Seal(obj), gs.IsNil)
+		c.Expect(obj.ContentType, gs.Equals, "application/octet-stream")
+		c.Expect(obj.UserMeta["key-id"], gs.Equals, "k1")
+		c.Expect(bytes.Contains(obj.Value, []byte(`{"a":1}`)), gs.IsFalse)
+
+		err = KeyRing{"k0": key}.Open(obj)
+		c.Expect(err.Error(), gs.Equals, "Unknown encryption key: k1")
+
+		// Values are bound to their object
+		moved := *obj
+		moved.Key = "b"
+		c.Expect(KeyRing{"k1": key}.Open(&moved), gs.Not(gs.IsNil))
+
+		// Read back with the default bucket type, as Walk does
+		obj.BucketType = "default"
+		c.Expect(KeyRing{"k0": key, "k1": key}.Open(obj), gs.IsNil)
+		c.Expect(string(obj.Value), gs.Equals, `{"a":1}`)
+		c.Expect(obj.ContentType, gs.Equals, "application/json")
+		c.Expect(len(obj.UserMeta), gs.Equals, 0)
+	})
+
+	c.Specify("Should load hex encoded key files only", func() {
+		dir, err := ioutil.TempDir("", "riak-key")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		path := dir + "/key"
+
+		ioutil.WriteFile(path, []byte("000102030405060708090a0b0c0d0e0f\n"), 0600)
+		key, err := LoadKeyFile(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(key), gs.Equals, 16)
+
+		// Raw keys are rejected
+		ioutil.WriteFile(path, []byte("0123456789abcdefghijklmnopqrstuv"), 0600)
+		_, err = LoadKeyFile(path)
+		c.Expect(strings.HasPrefix(err.Error(), "Key file "+path+" isn't hex encoded"), gs.IsTrue)
+		ioutil.WriteFile(path, []byte("0001"), 0600)
+		_, err = LoadKeyFile(path)
+		c.Expect(err.Error(), gs.Equals, "Key file "+path+" doesn't hold a 16, 24 or 32 bytes AES key")
+	})
+
+	c.Specify("Should compress values above the minimum size", func() {
+		value := bytes.Repeat([]byte(`{"Payload":"Test Payload"}`), 10)
+		for _, algorithm := range []string{"gzip", "snappy", "zstd"} {
+			compressor, err := newCompressor(algorithm, 100)
+			c.Expect(err, gs.IsNil)
+
+			obj := &RiakObject{Value: []byte("small")}
+			c.Expect(compressor.Compress(obj), gs.IsNil)
+			c.Expect(string(obj.Value), gs.Equals, "small")
+			c.Expect(obj.UserMeta, gs.IsNil)
+
+			obj.Value = value
+			c.Expect(compressor.Compress(obj), gs.IsNil)
+			c.Expect(len(obj.Value) < len(value), gs.IsTrue)
+			c.Expect(obj.UserMeta["compression"], gs.Equals, algorithm)
+			c.Expect(Decompress(obj), gs.IsNil)
+			c.Expect(obj.Value, gs.Equals, value)
+			c.Expect(obj.ContentEncoding, gs.Equals, "")
+		}
+		_, err := newCompressor("lz4", 0)
+		c.Expect(err.Error(), gs.Equals, "Unknown compression: lz4")
+	})
+
+	c.Specify("Should route messages to the first matching route", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.W = "quorum"
+		conf.Routes = []RouteConfig{
+			{MessageMatcher: "Type == 'audit'", Index: "audit", Format: "raw", W: "all"},
+			{MessageMatcher: "Type == 'TEST'", Index: "tests", Fields: []string{"Type"}},
+		}
+		c.Expect(output.Init(conf), gs.IsNil)
+		pack := &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+
+		obj, err := output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Bucket, gs.Equals, "tests")
+		c.Expect(string(obj.Value), gs.Equals, `{"Type":"TEST"}`)
+		c.Expect(obj.Options.Encode(), gs.Equals, "w=quorum")
+
+		pack.Message.SetType("audit")
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Bucket, gs.Equals, "audit")
+		c.Expect(obj.Options.Encode(), gs.Equals, "w=all")
+
+		pack.Message.SetType("other")
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(strings.HasPrefix(obj.Bucket, "heka-"), gs.IsTrue)
+
+		conf.Routes = []RouteConfig{{Index: "nowhere"}}
+		c.Expect(output.Init(conf), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Should generate keys with the configured strategy", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Fields = []string{"Type"}
+		conf.Id = "%{idField}"
+		pack := &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+		keys := map[string]string{
+			"template": "1234",
+			"uuid":     "87cf1ac2-e810-4ddf-a02d-a5ce44d13a85",
+			"ulid":     "017ZM2QCDEGZ7HNGQ8216XZ81D",
+			"ksuid":    "0000048GbtNWn3mnV8GEXF3Xn53",
+			"hash":     "d740c117007f71958c1ac9e77381ccd9bd63dfc38ca151328b4691cd8b4cbb35",
+		}
+		for strategy, key := range keys {
+			conf.KeyStrategy = strategy
+			c.Expect(output.Init(conf), gs.IsNil)
+			obj, err := output.handleMessage(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(obj.Key, gs.Equals, key)
+		}
+
+		t, _ := time.Parse(time.RFC3339, "2016-01-01T00:00:00Z")
+		c.Expect(ksuid(t, pack.Message.GetUuid()), gs.Equals, "0RD6atTsGULEDJ4GPh844q00TZN")
+		c.Expect(ksuid(t, nil) < ksuid(t.Add(time.Second), nil), gs.IsTrue)
+		c.Expect(ulid(t, nil) < ulid(t.Add(time.Millisecond), nil), gs.IsTrue)
+
+		conf.KeyStrategy = "random"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Unsupported key_strategy: random")
+	})
+
+	c.Specify("Should deduplicate messages", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.KeyStrategy = "uuid"
+		conf.Dedup = true
+		conf.DedupCacheSize = 2
+		c.Expect(output.Init(conf), gs.IsNil)
+		pack := &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+
+		obj, err := output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.IfNoneMatch, gs.IsTrue)
+		c.Expect(obj.Uuid, gs.Equals, "87cf1ac2-e810-4ddf-a02d-a5ce44d13a85")
+
+		var ifNoneMatch []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}))
+		defer server.Close()
+		indexer := NewHttpBulkIndexer("http", server.Listener.Addr().String(), 1, 0)
+		success, err := indexer.Index([]*RiakObject{obj})
+		c.Expect(err, gs.IsNil)
+		c.Expect(success, gs.IsTrue)
+		obj.IfNoneMatch = false
+		_, err = indexer.Index([]*RiakObject{obj})
+		c.Expect(err.Error(), gs.Equals, "Store response in error: 412 Precondition Failed")
+		c.Expect(strings.Join(ifNoneMatch, ","), gs.Equals, "*,")
+
+		output.dedupCache.AddObjects([]*RiakObject{obj, {}})
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj == nil, gs.IsTrue)
+
+		output.dedupCache.Add("a")
+		output.dedupCache.Add("b")
+		c.Expect(output.dedupCache.Contains(pack.Message.GetUuidString()), gs.IsFalse)
+		c.Expect(output.dedupCache.Contains("a"), gs.IsTrue)
+
+		// Template keys may be overwritten
+		conf.KeyStrategy = "template"
+		conf.Id = "%{Hostname}-latest"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Key, gs.Equals, "hostname-latest")
+		c.Expect(obj.IfNoneMatch, gs.IsFalse)
+	})
+
+	c.Specify("Should apply TTLs by route and severity", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.TTL = "30d"
+		conf.SeverityTTL = map[string]string{"debug": "72h", "3": "10d"}
+		conf.TTLBucketTypes = map[string]string{"3d": "short", "10d": "medium", "30d": "long", "3650d": "archive"}
+		conf.Routes = []RouteConfig{{MessageMatcher: "Type == 'audit'", Index: "audit", TTL: "3650d"}}
+		c.Expect(output.Init(conf), gs.IsNil)
+		pack := &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+
+		obj, err := output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.BucketType, gs.Equals, "long")
+		c.Expect(obj.UserMeta["ttl"], gs.Equals, "2592000")
+		c.Expect(obj.UserMeta["expires"], gs.Equals, "2013-08-15T15:49:05Z")
+
+		pack.Message.SetSeverity(7)
+		obj, _ = output.handleMessage(pack)
+		c.Expect(obj.BucketType, gs.Equals, "short")
+		c.Expect(obj.UserMeta["ttl"], gs.Equals, "259200")
+
+		pack.Message.SetType("audit")
+		obj, _ = output.handleMessage(pack)
+		c.Expect(obj.BucketType, gs.Equals, "archive")
+		c.Expect(obj.UserMeta["expires"], gs.Equals, "2023-07-14T15:49:05Z")
+
+		conf.TTL = ""
+		conf.SeverityTTL = nil
+		c.Expect(output.Init(conf), gs.IsNil)
+		pack.Message.SetType("TEST")
+		obj, _ = output.handleMessage(pack)
+		c.Expect(len(obj.UserMeta["ttl"]), gs.Equals, 0)
+		c.Expect(obj.BucketType, gs.Equals, "default")
+
+		// TTLs which nothing would expire are rejected
+		conf.TTL = "1d"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "TTL 1d has no bucket type in ttl_bucket_types")
+		conf.TTL = ""
+		conf.Routes[0].TTL = "1h"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "routes[0]: TTL 1h has no bucket type in ttl_bucket_types")
+		conf.Routes = nil
+
+		conf.SeverityTTL = map[string]string{"verbose": "1d"}
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Invalid severity: verbose")
+		conf.SeverityTTL = map[string]string{"debug": "soon"}
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Invalid TTL: soon")
+	})
+
+	c.Specify("Should write batches concurrently and drain them on shutdown", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Concurrency = 3
+		conf.OrderByKey = true
+		c.Expect(output.Init(conf), gs.IsNil)
+		c.Expect(len(output.batchChans), gs.Equals, 3)
+		c.Expect(cap(output.backChan), gs.Equals, 6)
+
+		keys := make(map[int][]string)
+		lock := new(sync.Mutex)
+		for i := range output.bulkIndexers {
+			output.bulkIndexers[i] = &recordingIndexer{lock: lock, keys: keys, n: i}
+		}
+		var wg sync.WaitGroup
+		wg.Add(output.concurrency)
+		for i := 0; i < output.concurrency; i++ {
+			go output.committer(nil, &wg, i)
+		}
+		r := &receiverState{outBatches: make([][]*RiakObject, len(output.batchChans))}
+		for round := 0; round < 2; round++ {
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				obj := &RiakObject{Bucket: "heka", Key: key}
+				i := output.partition(obj)
+				r.outBatches[i] = append(r.outBatches[i], obj)
+			}
+			output.sendBatches(nil, r, round == 0)
+		}
+		for _, batchChan := range output.batchChans {
+			close(batchChan)
+		}
+		wg.Wait()
+
+		written := 0
+		for i, indexed := range keys {
+			for _, key := range indexed {
+				// Every write of a key goes through the same committer
+				c.Expect(output.partition(&RiakObject{Bucket: "heka", Key: key}), gs.Equals, i)
+				written++
+			}
+		}
+		c.Expect(written, gs.Equals, 10)
+
+		conf.Concurrency = 0
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Invalid concurrency: 0")
+		conf.Concurrency = 4
+		conf.OrderByKey = false
+		c.Expect(output.Init(conf), gs.IsNil)
+		c.Expect(len(output.batchChans), gs.Equals, 1)
+		c.Expect(output.partition(&RiakObject{Key: "a"}), gs.Equals, 0)
+	})
+
+	c.Specify("Should flush on count or bytes", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.FlushBytes = 1000
+		c.Expect(output.Init(conf), gs.IsNil)
+		indexer := output.bulkIndexers[0]
+		c.Expect(indexer.CheckFlush(9, 999), gs.IsFalse)
+		c.Expect(indexer.CheckFlush(10, 0), gs.IsTrue)
+		c.Expect(indexer.CheckFlush(1, 1000), gs.IsTrue)
+	})
+
+	c.Specify("Should adapt the batch size to latency and errors", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.AdaptiveFlush = true
+		conf.FlushCount = 100
+		conf.FlushCountMin = 10
+		conf.FlushCountMax = 120
+		conf.FlushLatencyTarget = 100
+		c.Expect(output.Init(conf), gs.IsNil)
+		adaptive := output.adaptiveFlush
+		c.Expect(output.bulkIndexers[0].CheckFlush(100, 0), gs.IsTrue)
+
+		adaptive.Observe(10*time.Millisecond, false)
+		c.Expect(adaptive.Count(), gs.Equals, 110)
+		adaptive.Observe(10*time.Millisecond, false)
+		adaptive.Observe(10*time.Millisecond, false)
+		c.Expect(adaptive.Count(), gs.Equals, 120)
+		c.Expect(output.bulkIndexers[0].CheckFlush(110, 0), gs.IsFalse)
+
+		adaptive.Observe(10*time.Millisecond, true)
+		c.Expect(adaptive.Count(), gs.Equals, 60)
+		for i := 0; i < 20; i++ {
+			adaptive.Observe(time.Second, false)
+		}
+		c.Expect(adaptive.Count(), gs.Equals, 10)
+
+		conf.FlushCountMax = 5
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Invalid adaptive flush bounds: 10 to 5")
+	})
+
+	c.Specify("Should shed the least severe messages on overflow", func() {
+		// The severity 7 message goes first, then the oldest or newest
+		// severity 6 one
+		for policy, expected := range map[string]string{
+			"drop_oldest": "adefgh",
+			"drop_newest": "abdefh",
+		} {
+			q := newOverflowQueue(policy, 60, nil)
+			dropped, _, err := q.Push(getTestBatch("abcd", 3, 6, 7, 6))
+			c.Expect(err, gs.IsNil)
+			c.Expect(dropped, gs.Equals, 0)
+			dropped, _, _ = q.Push(getTestBatch("efgh", 6, 6, 6, 3))
+			c.Expect(dropped, gs.Equals, 2)
+
+			q.Close()
+			keys := ""
+			for batch, ok, _ := q.Pop(); ok; batch, ok, _ = q.Pop() {
+				keys += batchKeys(batch)
+			}
+			c.Expect(keys, gs.Equals, expected)
+		}
+
+		q := newOverflowQueue(overflowDropOldest, 40, nil)
+		q.Push(getTestBatch("abc", 6, 6, 6))
+		dropped, _, _ := q.Push(getTestBatch("de", 6, 6))
+		c.Expect(dropped, gs.Equals, 1)
+		batch, _, _ := q.Pop()
+		c.Expect(batchKeys(batch), gs.Equals, "bc")
+	})
+
+	c.Specify("Should dispatch queued batches to the committers", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.OverflowPolicy = "drop_oldest"
+		conf.Concurrency = 2
+		c.Expect(output.Init(conf), gs.IsNil)
+		keys := make(map[int][]string)
+		lock := new(sync.Mutex)
+		for i := range output.bulkIndexers {
+			output.bulkIndexers[i] = &recordingIndexer{lock: lock, keys: keys, n: i}
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go output.dispatcher(nil, &wg)
+		go output.committer(nil, &wg, 0)
+		go output.committer(nil, &wg, 1)
+		for _, key := range []string{"ab", "cd", "ef"} {
+			r := &receiverState{outBatches: [][]*RiakObject{getTestBatch(key, 6, 6)}}
+			output.sendBatches(nil, r, true)
+			c.Expect(len(r.outBatches[0]), gs.Equals, 0)
+		}
+		output.overflow.Close()
+		wg.Wait()
+		c.Expect(len(keys[0])+len(keys[1]), gs.Equals, 6)
+	})
+
+	c.Specify("Should spool batches beyond the memory budget", func() {
+		dir, err := ioutil.TempDir("", "riak-spool")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.OverflowPolicy = "spool"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "spool_dir is required to spool batches")
+		conf.SpoolDir = dir
+		conf.OverflowMemory = 30
+		c.Expect(output.Init(conf), gs.IsNil)
+
+		q := output.overflow
+		q.Push(getTestBatch("ab", 6, 6))
+		q.Push(getTestBatch("cd", 6, 6))
+		q.Push(getTestBatch("e", 6))
+		c.Expect(q.spool.Len(), gs.Equals, 2)
+
+		// Spooled batches survive restarts
+		c.Expect(output.Init(conf), gs.IsNil)
+		q = output.overflow
+		c.Expect(q.spool.Len(), gs.Equals, 2)
+		q.Push(getTestBatch("f", 6))
+		keys := ""
+		for i := 0; i < 2; i++ {
+			batch, ok, err := q.Pop()
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(err, gs.IsNil)
+			keys += batchKeys(batch) + " "
+		}
+		c.Expect(keys, gs.Equals, "cd e ")
+
+		// Once closed, spooled batches are left for the next run
+		q.Close()
+		_, ok, _ := q.Pop()
+		c.Expect(ok, gs.IsFalse)
+		c.Expect(q.spool.Len(), gs.Equals, 1)
+
+		conf.OverflowPolicy = "later"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Unsupported overflow_policy: later")
+	})
+
+	c.Specify("Should open circuit breakers after consecutive failures", func() {
+		var changes []string
+		now := time.Now()
+		breaker := newCircuitBreaker("node a", 2, time.Second, func(name string, from breakerState, to breakerState) {
+			changes = append(changes, fmt.Sprintf("%s %s>%s", name, from, to))
+		})
+		breaker.now = func() time.Time { return now }
+
+		breaker.Failure()
+		breaker.Success()
+		breaker.Failure()
+		allowed, _ := breaker.Allow()
+		c.Expect(allowed, gs.IsTrue)
+		breaker.Failure()
+		allowed, _ = breaker.Allow()
+		c.Expect(allowed, gs.IsFalse)
+		c.Expect(breaker.Remaining(), gs.Equals, time.Second)
+
+		now = now.Add(time.Second)
+		allowed, probe := breaker.Allow()
+		c.Expect(allowed && probe, gs.IsTrue)
+		allowed, _ = breaker.Allow()
+		c.Expect(allowed, gs.IsFalse)
+		breaker.Failure()
+		c.Expect(breaker.Remaining(), gs.Equals, time.Second)
+
+		now = now.Add(time.Second)
+		breaker.Allow()
+		breaker.Success()
+		allowed, probe = breaker.Allow()
+		c.Expect(allowed && !probe, gs.IsTrue)
+		c.Expect(strings.Join(changes, ", "), gs.Equals, "node a closed>open, node a open>half-open, "+
+			"node a half-open>open, node a open>half-open, node a half-open>closed")
+	})
+
+	c.Specify("Should fail over to the next node and fast-fail a down cluster", func() {
+		var failing, working int
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			failing++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer down.Close()
+		var stored []string
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			working++
+			if strings.HasSuffix(r.URL.Path, "/keys/bad") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			stored = append(stored, r.URL.Path)
+		}))
+		defer up.Close()
+
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Servers = []string{down.URL, up.URL}
+		conf.BreakerThreshold = 1
+		c.Expect(output.Init(conf), gs.IsNil)
+		indexer := output.bulkIndexers[0]
+
+		batch := []*RiakObject{{Bucket: "heka", Key: "a"}, {Bucket: "heka", Key: "b"}}
+		success, err := indexer.Index(batch)
+		c.Expect(err, gs.IsNil)
+		c.Expect(success, gs.IsTrue)
+		c.Expect(failing, gs.Equals, 1)
+		c.Expect(working, gs.Equals, 2)
+
+		// Client errors are the fault of the object, not the node
+		_, err = indexer.Index([]*RiakObject{{Bucket: "heka", Key: "bad"}})
+		c.Expect(err.Error(), gs.Equals, "Store response in error: 400 Bad Request")
+		_, err = indexer.Index(batch)
+		c.Expect(err, gs.IsNil)
+
+		// The rest of the batch is still stored
+		stored = nil
+		success, err = indexer.Index([]*RiakObject{{Bucket: "heka", Key: "a"}, {Bucket: "heka", Key: "bad"},
+			{Bucket: "heka", Key: "c"}})
+		c.Expect(success, gs.IsFalse)
+		c.Expect(err.Error(), gs.Equals, "Store response in error: 400 Bad Request")
+		c.Expect(stored, gs.Equals, []string{"/buckets/heka/keys/a", "/buckets/heka/keys/c"})
+
+		up.Close()
+		_, err = indexer.Index(batch)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = indexer.Index(batch)
+		c.Expect(err, gs.Equals, errClusterOpen)
+		c.Expect(failing, gs.Equals, 1)
+		// A failed probe keeps it open, with the batch handled the same way
+		output.clusterBreaker.now = func() time.Time {
+			return time.Now().Add(time.Hour)
+		}
+		_, err = indexer.Index(batch)
+		c.Expect(err, gs.Equals, errClusterOpen)
+		c.Expect(failing, gs.Equals, 2)
+
+		output.handleMessage(&pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()})
+		output.stats.lastError.Store("Store response in error: 400 Bad Request")
+		report := &Message{}
+		c.Expect(output.ReportMsg(report), gs.IsNil)
+		for name, expected := range map[string]int64{
+			"FormattedMessageCount": 1,
+			"WrittenMessageCount":   6,
+			"FailedMessageCount":    4,
+			"RetriedWriteCount":     1,
+			"BatchesInFlight":       0,
+		} {
+			value, _ := report.GetFieldValue(name)
+			c.Expect(value, gs.Equals, expected)
+		}
+		value, ok := report.GetFieldValue(strings.TrimPrefix(up.URL, "http://") + "-AverageLatency")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(value.(int64) >= 0, gs.IsTrue)
+		value, _ = report.GetFieldValue("LastError")
+		c.Expect(value, gs.Equals, "Store response in error: 400 Bad Request")
+
+		conf.BreakerOpenPolicy = "spool"
+		c.Expect(output.Init(conf).Error(), gs.Equals,
+			"breaker_open_policy spool requires the spool overflow_policy")
+
+		dir, err := ioutil.TempDir("", "riak-breaker")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		conf.OverflowPolicy = "spool"
+		conf.SpoolDir = dir
+		c.Expect(output.Init(conf), gs.IsNil)
+		output.clusterBreaker.Failure()
+		c.Expect(output.clusterBreaker.Remaining() > 0, gs.IsTrue)
+		// Shutting down, batches are spooled without waiting for the cooldown
+		close(output.stopping)
+		start := time.Now()
+		output.spoolBatch(nil, getTestBatch("ab", 6, 6))
+		c.Expect(time.Since(start) < time.Second, gs.IsTrue)
+		// and counted once, even when spooled again
+		spooled, err := output.overflow.spool.Pop()
+		c.Expect(err, gs.IsNil)
+		output.spoolBatch(nil, spooled)
+		c.Expect(output.overflow.spool.Len(), gs.Equals, 1)
+		c.Expect(output.stats.spooled, gs.Equals, int64(2))
+	})
+
+	c.Specify("Should save the batches left at the shutdown timeout", func() {
+		dir, err := ioutil.TempDir("", "riak-shutdown")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.ShutdownTimeout = 100
+		conf.DeadLetterFile = dir + "/lost.json"
+		c.Expect(output.Init(conf), gs.IsNil)
+		c.Expect(output.abandon(), gs.IsNil)
+
+		written := getTestBatch("ab", 6, 6)
+		output.tracker.Hold(written)
+		output.tracker.Release(written)
+		left := getTestBatch("cde", 6, 6, 3)
+		left[2].Bucket = "audit"
+		output.tracker.Hold(left)
+		c.Expect(output.abandon().Error(), gs.Equals, "Shutdown timeout: 3 messages (30 bytes) "+
+			"not written, by bucket: =2, audit=1; written to "+conf.DeadLetterFile)
+		data, err := ioutil.ReadFile(conf.DeadLetterFile)
+		c.Expect(err, gs.IsNil)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		c.Expect(len(lines), gs.Equals, 3)
+		c.Expect(strings.Contains(lines[2], `"Bucket":"audit","Key":"e"`), gs.IsTrue)
+
+		conf.OverflowPolicy = "spool"
+		conf.SpoolDir = dir + "/spool"
+		c.Expect(output.Init(conf), gs.IsNil)
+		output.overflow.Push(getTestBatch("fg", 6, 6))
+		output.tracker.Hold(left)
+		c.Expect(output.abandon().Error(), gs.Equals, "Shutdown timeout: 5 messages (50 bytes) "+
+			"not written, by bucket: =4, audit=1; spooled to "+conf.SpoolDir)
+		c.Expect(output.overflow.spool.Len(), gs.Equals, 2)
+	})
+
+	c.Specify("Should give up on stuck committers at the shutdown timeout", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Index = "logs"
+		conf.ShutdownTimeout = 100
+		c.Expect(output.Init(conf), gs.IsNil)
+		stuck := &stuckIndexer{release: make(chan struct{})}
+		defer close(stuck.release)
+		output.bulkIndexers[0] = stuck
+
+		// The first message is stuck in the committer, the second one waits
+		// for it while the third one and the closing are read
+		or := &testOutputRunner{inChan: make(chan *pipeline.PipelinePack, 3)}
+		for i := 0; i < 3; i++ {
+			or.inChan <- &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+		}
+		close(or.inChan)
+		done := make(chan error)
+		go func() {
+			done <- output.Run(or, nil)
+		}()
+		returned := false
+		select {
+		case err := <-done:
+			c.Expect(err, gs.IsNil)
+			returned = true
+		case <-time.After(5 * time.Second):
+		}
+		c.Expect(returned, gs.IsTrue)
+		c.Expect(output.stats.received, gs.Equals, int64(3))
+		c.Expect(len(or.errors), gs.Equals, 1)
+		c.Expect(or.errors[0], gs.Equals, "Shutdown timeout: 3 messages (846 bytes) not written, by bucket: logs=3; lost")
+	})
+
+	c.Specify("Should skip stats messages while no pack is free", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.StatsInterval = 1
+		c.Expect(output.Init(conf), gs.IsNil)
+		output.pluginName = "RiakOutput"
+		or := &testOutputRunner{}
+		h := &testPluginHelper{packs: make(chan *pipeline.PipelinePack)}
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			output.statsReporter(or, h, stop)
+			close(done)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		h.packs <- &pipeline.PipelinePack{Message: &Message{}}
+		time.Sleep(20 * time.Millisecond)
+		close(stop)
+		returned := false
+		select {
+		case <-done:
+			returned = true
+		case <-time.After(5 * time.Second):
+		}
+		c.Expect(returned, gs.IsTrue)
+		or.lock.Lock()
+		c.Expect(len(or.injected), gs.Equals, 1)
+		or.lock.Unlock()
+
+		// The stats of the output aren't stored by it
+		obj, err := output.handleMessage(or.injected[0])
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj == nil, gs.IsTrue)
+	})
+
+	c.Specify("Should fill stats messages with percentiles", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Servers = []string{"http://riak1:8098", "http://riak2:8098"}
+		c.Expect(output.Init(conf), gs.IsNil)
+		output.pluginName = "RiakOutput"
+		for i := int64(1); i <= 200; i++ {
+			output.latencies.Add(i * int64(time.Millisecond))
+		}
+		for _, size := range []int64{10, 10, 10, 4} {
+			output.batchSizes.Add(size)
+		}
+		output.nodeStats[1].observe(time.Millisecond, true)
+
+		msg := &Message{}
+		output.statsMessage(msg)
+		c.Expect(msg.GetType(), gs.Equals, "heka.riak-output.stats")
+		c.Expect(msg.GetLogger(), gs.Equals, "RiakOutput")
+		for name, expected := range map[string]int64{
+			"StoreLatencyP50":   100000,
+			"StoreLatencyP95":   190000,
+			"StoreLatencyP99":   198000,
+			"StoreCount":        200,
+			"BatchSizeP50":      10,
+			"BatchSizeP100":     10,
+			"BatchCount":        4,
+			"riak1:8098-Errors": 0,
+			"riak2:8098-Errors": 1,
+		} {
+			value, _ := msg.GetFieldValue(name)
+			c.Expect(value, gs.Equals, expected)
+		}
+
+		// Percentiles are of the samples since the last message
+		msg = &Message{}
+		output.statsMessage(msg)
+		value, _ := msg.GetFieldValue("StoreLatencyP99")
+		c.Expect(value, gs.Equals, int64(0))
+
+		// Counts go beyond the samples kept
+		for i := int64(0); i < maxSamples+5; i++ {
+			output.latencies.Add(i)
+		}
+		msg = &Message{}
+		output.statsMessage(msg)
+		value, _ = msg.GetFieldValue("StoreCount")
+		c.Expect(value, gs.Equals, int64(maxSamples+5))
+		c.Expect(percentile([]int64{4, 10, 10, 10}, 25), gs.Equals, int64(4))
+	})
+
+	c.Specify("Should keep objects within max_object_size", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Format = "payload"
+		conf.MaxObjectSize = 100
+		c.Expect(output.Init(conf), gs.IsNil)
+		msg := getTestMessageWithFunnyFields()
+		msg.SetPayload(strings.Repeat("é", 150))
+		pack := &pipeline.PipelinePack{Message: msg}
+
+		obj, err := output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(obj.Value) <= 100, gs.IsTrue)
+		c.Expect(strings.HasSuffix(string(obj.Value), "é... [truncated 226 bytes]"), gs.IsTrue)
+		c.Expect(obj.UserMeta["truncated"], gs.Equals, "226")
+		c.Expect(msg.GetPayload(), gs.Equals, strings.Repeat("é", 150))
+
+		conf.MaxObjectPolicy = "split"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Key, gs.Equals, "87cf1ac2-e810-4ddf-a02d-a5ce44d13a85")
+		c.Expect(obj.UserMeta["chunks"], gs.Equals, "3")
+		c.Expect(len(obj.chunks), gs.Equals, 2)
+		value := string(obj.Value)
+		for i, chunk := range obj.chunks {
+			c.Expect(chunk.Key, gs.Equals, fmt.Sprintf("%s.%d", obj.Key, i+1))
+			c.Expect(chunk.UserMeta["chunk"], gs.Equals, fmt.Sprint(i+1))
+			c.Expect(chunk.UserMeta["chunk-of"], gs.Equals, obj.Key)
+			c.Expect(chunk.Severity, gs.Equals, int32(6))
+			value += string(chunk.Value)
+		}
+		c.Expect(value, gs.Equals, msg.GetPayload())
+		c.Expect(obj.Links[1].Header(), gs.Equals,
+			`</buckets/`+obj.Bucket+`/keys/`+obj.Key+`.2>; riaktag="chunk"`)
+
+		conf.OrderByKey = true
+		conf.Concurrency = 3
+		c.Expect(output.Init(conf), gs.IsNil)
+		r := &receiverState{outBatches: make([][]*RiakObject, 3)}
+		output.receive(nil, r, pack)
+		// The chunks go through the committer of the object, queued or not
+		c.Expect(len(r.outBatches[output.partition(obj)]), gs.Equals, 3)
+		for i := 1; i <= 20; i++ {
+			chunk := &RiakObject{BucketType: obj.BucketType, Bucket: obj.Bucket, Key: fmt.Sprintf("%s.%d", obj.Key, i),
+				UserMeta: map[string]string{"chunk-of": obj.Key}}
+			c.Expect(output.partition(chunk), gs.Equals, output.partition(obj))
+		}
+
+		conf.MaxObjectPolicy = "dead_letter"
+		c.Expect(output.Init(conf).Error(), gs.Equals, "max_object_policy dead_letter requires a dead_letter_bucket")
+		conf.DeadLetterBucket = "dead"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err.Error(), gs.Equals, "Object of 300 bytes is larger than max_object_size 100")
+		c.Expect(obj.Bucket, gs.Equals, "dead")
+
+		conf.MaxObjectPolicy = "drop"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj == nil, gs.IsTrue)
+		c.Expect(output.stats.oversized, gs.Equals, int64(1))
+		c.Expect(output.stats.dropped, gs.Equals, int64(1))
+	})
+
+	c.Specify("Should join split objects whatever the order of their links", func() {
+		stored := make(map[string]*http.Request)
+		values := make(map[string][]byte)
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.Method == "PUT" {
+				stored[r.URL.Path] = r
+				values[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+				return
+			}
+			request, ok := stored[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			for name, headers := range request.Header {
+				if strings.HasPrefix(name, "X-Riak-Meta-") {
+					w.Header()[name] = headers
+				}
+			}
+			// Links in the reverse order
+			links := request.Header["Link"]
+			for i := len(links) - 1; i >= 0; i-- {
+				w.Header().Add("Link", links[i])
+			}
+			w.Write(values[r.URL.Path])
+		}))
+		defer server.Close()
+
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Index = "logs"
+		conf.Format = "payload"
+		conf.MaxObjectSize = 100
+		conf.MaxObjectPolicy = "split"
+		indexer := NewHttpBulkIndexer("http", server.Listener.Addr().String(), 1, 0)
+		reader := NewRiakReader("http://"+server.Listener.Addr().String(), nil, time.Second)
+		msg := getTestMessageWithFunnyFields()
+		msg.SetPayload(strings.Repeat("0123456789", 35))
+		for _, typeName := range []string{"default", "archive"} {
+			conf.TypeName = typeName
+			c.Expect(output.Init(conf), gs.IsNil)
+			obj, err := output.handleMessage(&pipeline.PipelinePack{Message: msg})
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(obj.chunks), gs.Equals, 3)
+			if typeName == "default" {
+				c.Expect(len(obj.Links), gs.Equals, 3)
+			} else {
+				// Riak doesn't keep links in other bucket types
+				c.Expect(len(obj.Links), gs.Equals, 0)
+			}
+			_, err = indexer.Index(append(obj.chunks, obj))
+			c.Expect(err, gs.IsNil)
+
+			fetched, err := reader.Fetch(typeName, obj.Bucket, obj.Key)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(fetched.Value), gs.Equals, msg.GetPayload())
+			c.Expect(len(fetched.Links), gs.Equals, 0)
+		}
+	})
+
+	c.Specify("Should write links and walk them with the reader", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Index = "logs"
+		conf.Format = "payload"
+		conf.InterpolateMissing = "error"
+		conf.Compression = "gzip"
+		conf.CompressionMinSize = 1
+		conf.MaxObjectSize = 20
+		conf.MaxObjectPolicy = "split"
+		conf.Links = []LinkConfig{
+			{Key: "req-%{idField}", Tag: "%{Type}"},
+			{Bucket: "requests", Key: "%{request_id}", Tag: "start"},
+		}
+		dir, err := ioutil.TempDir("", "riak-links")
+		c.Expect(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		conf.EncryptionKeyFile = dir + "/key"
+		conf.EncryptionKeyId = "k1"
+		ioutil.WriteFile(conf.EncryptionKeyFile, []byte("000102030405060708090a0b0c0d0e0f"), 0600)
+		c.Expect(output.Init(conf), gs.IsNil)
+		msg := getTestMessageWithFunnyFields()
+		msg.SetPayload(strings.Repeat("Test Payload ", 10))
+		obj, err := output.handleMessage(&pipeline.PipelinePack{Message: msg})
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Links[0], gs.Equals, RiakLink{Bucket: obj.Bucket, Key: "req-1234", Tag: "TEST"})
+		c.Expect(obj.Links[1].Tag, gs.Equals, "chunk")
+		// Encrypted objects are keyed by the message UUID
+		c.Expect(obj.Key, gs.Equals, msg.GetUuidString())
+
+		stored := make(map[string]*http.Request)
+		values := make(map[string][]byte)
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			// Like Riak, the default bucket type is implied
+			path := strings.TrimPrefix(r.URL.Path, "/types/default")
+			if r.Method == "PUT" {
+				stored[path] = r
+				values[path], _ = ioutil.ReadAll(r.Body)
+				return
+			}
+			request, ok := stored[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			for name, headers := range request.Header {
+				if name == "Content-Type" || name == "Content-Encoding" || name == "Link" ||
+					strings.HasPrefix(name, "X-Riak-Meta-") {
+					w.Header()[name] = headers
+				}
+			}
+			w.Header().Add("Link", `</buckets/`+obj.Bucket+`>; rel="up"`)
+			w.Write(values[path])
+		}))
+		defer server.Close()
+		indexer := NewHttpBulkIndexer("http", server.Listener.Addr().String(), 1, 0)
+		target := &RiakObject{BucketType: "default", Bucket: obj.Bucket, Key: "req-1234",
+			ContentType: "text/plain", Value: []byte("start")}
+		_, err = indexer.Index(append(append(obj.chunks, obj), target))
+		c.Expect(err, gs.IsNil)
+
+		key, _ := LoadKeyFile(conf.EncryptionKeyFile)
+		reader := NewRiakReader("http://"+server.Listener.Addr().String(), KeyRing{"k1": key}, time.Second)
+		fetched, err := reader.Fetch("default", obj.Bucket, obj.Key)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(fetched.Value), gs.Equals, msg.GetPayload())
+		c.Expect(fetched.ContentType, gs.Equals, "text/plain")
+		c.Expect(len(fetched.Links), gs.Equals, 1)
+		linked, err := reader.Walk(fetched, "TEST")
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(linked), gs.Equals, 1)
+		c.Expect(string(linked[0].Value), gs.Equals, "start")
+		linked, err = reader.Walk(fetched, "other")
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(linked), gs.Equals, 0)
+
+		_, err = reader.Fetch("default", obj.Bucket, "missing")
+		c.Expect(err.Error(), gs.Equals, "Store response in error: 404 Not Found")
+		c.Expect(parseLinks([]string{`</riak/b%2C/k>; riaktag="a+b", </buckets/b/keys/k>; riaktag="c"`}),
+			gs.Equals, []RiakLink{{Bucket: "b,", Key: "k", Tag: "a b"}, {Bucket: "b", Key: "k", Tag: "c"}})
+		// Riak splits Link headers on commas
+		link := RiakLink{Bucket: "b,", Key: "k,1", Tag: "c"}
+		c.Expect(link.Header(), gs.Equals, `</buckets/b%2C/keys/k%2C1>; riaktag="c"`)
+		c.Expect(parseLinks([]string{link.Header() + ", " + link.Header()}), gs.Equals, []RiakLink{link, link})
+
+		conf.EncryptionKeyFile = ""
+		conf.Links = []LinkConfig{{Tag: "start"}}
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Link without a key")
+		conf.Links = []LinkConfig{{Key: "%{request_id}"}}
+		c.Expect(output.Init(conf).Error(), gs.Equals, "Link without a tag")
+		conf.Links = []LinkConfig{{Key: "req-%{idField}", Tag: "request"}}
+		conf.Routes = []RouteConfig{{MessageMatcher: "TRUE", TypeName: "audit"}}
+		c.Expect(output.Init(conf).Error(), gs.Equals, "routes[0]: Links require the default bucket type, not audit")
+
+		// Only the messages given another bucket type fail
+		conf.Routes = nil
+		conf.MaxObjectSize = 0
+		conf.TTLBucketTypes = map[string]string{"3d": "short_lived", "30d": "default"}
+		conf.TTL = "30d"
+		conf.SeverityTTL = map[string]string{"debug": "3d"}
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(&pipeline.PipelinePack{Message: msg})
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Links, gs.Equals, []RiakLink{{Bucket: "logs", Key: "req-1234", Tag: "request"}})
+		msg.SetSeverity(7)
+		_, err = output.handleMessage(&pipeline.PipelinePack{Message: msg})
+		c.Expect(err.Error(), gs.Equals, "Links require the default bucket type, not short_lived")
+	})
+
+	c.Specify("Should store messages which can't be formatted as dead letters", func() {
+		output := new(RiakOutput)
+		conf := output.ConfigStruct().(*RiakOutputConfig)
+		conf.Fields = []string{"Type", "Unknown"}
+		c.Expect(output.Init(conf), gs.IsNil)
+		pack := &pipeline.PipelinePack{Message: getTestMessageWithFunnyFields()}
+
+		obj, err := output.handleMessage(pack)
+		c.Expect(err.Error(), gs.Equals,
+			"Error in message conversion to clean format: Unable to find field: Unknown")
+		c.Expect(obj, gs.IsNil)
+
+		conf.DeadLetterBucket = "dead"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(obj.Bucket, gs.Equals, "dead")
+		c.Expect(obj.Key, gs.Equals, "87cf1ac2-e810-4ddf-a02d-a5ce44d13a85")
+		c.Expect(obj.ContentType, gs.Equals, "application/x-protobuf")
+		c.Expect(obj.UserMeta["error"], gs.Equals, err.Error())
+		c.Expect(len(obj.UserMeta["timestamp"]) > 0, gs.IsTrue)
+
+		// Buckets which can't be interpolated are only fatal with a dead
+		// letter bucket
+		conf.Fields = []string{"Type"}
+		conf.Index = "logs-%{missing}"
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err.Error(), gs.Equals, "Could not interpolate field from config: logs-%{missing}")
+		c.Expect(obj.Bucket, gs.Equals, "dead")
+		conf.DeadLetterBucket = ""
+		c.Expect(output.Init(conf), gs.IsNil)
+		obj, err = output.handleMessage(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Bucket, gs.Equals, "logs-missing")
+	})
+
+	c.Specify("Should interpolate non-string fields", func() {
+		msg := getTestMessageWithFunnyFields()
+		for _, value := range []interface{}{500, 0.25, true, []byte{0xfb, 0xff}} {
+			field, _ := NewField(fmt.Sprintf("%T", value), value, "")
+			msg.AddField(field)
+		}
+		template := "%{\"number}-%{int}-%{float64}-%{bool}-%{[]uint8}"
+
+		interpolated, err := interpolateFlag(&RiakCoordinates{}, msg, template)
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolated, gs.Equals, "64-500-0.25-true-fbff")
+
+		interpolated, err = interpolateFlag(&RiakCoordinates{BytesEncoding: "base64"}, msg, template)
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolated, gs.Equals, "64-500-0.25-true--_8=")
+	})
+
+	c.Specify("Should apply the missing field behavior", func() {
+		msg := getTestMessageWithFunnyFields()
+		interpolated, err := interpolateFlag(&RiakCoordinates{MissingField: "empty"}, msg, "a-%{missing}")
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolated, gs.Equals, "a-")
+
+		_, err = interpolateFlag(&RiakCoordinates{MissingField: "error"}, msg, "a-%{missing}")
+		c.Expect(err.Error(), gs.Equals, "Field missing is missing to interpolate a-%{missing}")
+	})
+
+	c.Specify("Should interpolate defaults, filters and time tokens", func() {
+		msg := getTestMessageWithFunnyFields()
+		paris, _ := time.LoadLocation("Europe/Paris")
+		e := &RiakCoordinates{Timestamp: msg.Timestamp, RiakIndexFromTimestamp: true, Location: paris}
+
+		t, err := compileTemplate("%{Hostname|upper}-%{missing|Unknown Host|slug}-%{time:2006.01.02T15}")
+		c.Expect(err, gs.IsNil)
+		interpolated, err := t.Render(e, msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolated, gs.Equals, "HOSTNAME-unknown-host-2013.07.16T17")
+
+		t, err = compileTemplate("%{Type|hash|truncate:8}-%{idField|truncate:2}")
+		c.Expect(err, gs.IsNil)
+		interpolated, err = t.Render(e, msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolated, gs.Equals, "94ee0593-12")
+
+		_, err = compileTemplate("%{Type|truncate:x}")
+		c.Expect(err.Error(), gs.Equals,
+			"Invalid interpolation in %{Type|truncate:x}: invalid truncate length: x")
+		_, err = compileTemplate("%{Hostname|lowr|unknown}")
+		c.Expect(err.Error(), gs.Equals,
+			"Invalid interpolation in %{Hostname|lowr|unknown}: more than one default: lowr and unknown")
+	})
+
+	c.Specify("Should build the HTTP path of Riak objects", func() {
+		index, _ := compileTemplate("heka")
+		typeName, _ := compileTemplate("%{Type}")
+		id, _ := compileTemplate("%{idField}")
+		obj, err := (&RiakCoordinates{Index: index, Type: typeName, Id: id}).Object(
+			getTestMessageWithFunnyFields())
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Path(), gs.Equals, "/types/TEST/buckets/heka/keys/1234")
+		obj.Key = ""
+		c.Expect(obj.Path(), gs.Equals, "/types/TEST/buckets/heka/keys")
+	})
+
+	c.Specify("Should sanitize and URL encode bucket and key names", func() {
+		msg := getTestMessageWithFunnyFields()
+		index, _ := compileTemplate("heka %{\"foo}")
+		typeName, _ := compileTemplate("%{\xa3}")
+		id, _ := compileTemplate("%{\"foo}/%{idField}?%{Type}")
+		obj, err := (&RiakCoordinates{Index: index, Type: typeName, Id: id}).Object(msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(obj.Path(), gs.Equals,
+			"/types/%A3/buckets/heka%20bar%0A/keys/bar%0A%2F1234%3FTEST")
+
+		sanitizer, err := newNameSanitizer("A-Za-z0-9_.-", "_", 20)
+		c.Expect(err, gs.IsNil)
+		c.Expect(sanitizer.SanitizeObject(obj), gs.IsNil)
+		c.Expect(obj.Path(), gs.Equals, "/types/_/buckets/heka_bar_/keys/bar_1234_TEST")
+
+		c.Expect(sanitizer.Sanitize("abcdefghijklmnopqrstuvwxyz"), gs.Equals, "abcdefghijk-71c480df")
+		c.Expect(sanitizer.Sanitize("abcdefghijklmnopqrstuvwxyZ"), gs.Not(gs.Equals), "abcdefghijk-71c480df")
+
+		obj.Bucket = "%%"
+		c.Expect(sanitizer.SanitizeObject(obj), gs.IsNil)
+		sanitizer, _ = newNameSanitizer("a-z", "", 0)
+		obj.Bucket = "%%"
+		c.Expect(sanitizer.SanitizeObject(obj).Error(), gs.Equals, "Bucket name is empty")
+	})
+
 	c.Specify("Should interpolate fields and message attributes for index and type names", func() {
 		interpolatedIndex, err := interpolateFlag(&RiakCoordinates{},
 			getTestMessageWithFunnyFields(), "heka-%{Pid}-%{\"foo}-%{2006.01.02}")
@@ -0,0 +1,134 @@
+package riak
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"net/url"
+	"time"
+)
+
+// ConfigStruct of a route, sending the messages it matches to its own
+// bucket, in its own format. Settings left empty default to the ones of the
+// output.
+type RouteConfig struct {
+	// Heka message matcher expression selecting the messages of the route
+	MessageMatcher string `toml:"message_matcher"`
+	// Bucket, bucket type and key templates
+	Index    string
+	TypeName string `toml:"type_name"`
+	Id       string
+	// Key strategy, see RiakOutputConfig
+	KeyStrategy string `toml:"key_strategy"`
+	// How long the objects of the route are kept, overriding the TTL of
+	// their severity (e.g. "72h" or "3650d")
+	TTL string `toml:"ttl"`
+	// Format and fields of the documents
+	Format string
+	Fields []string
+	// Links of the objects, see RiakOutputConfig
+	Links []LinkConfig
+	// Write quorums: a number of replicas, "one", "quorum" or "all"
+	W  string `toml:"w"`
+	DW string `toml:"dw"`
+	PW string `toml:"pw"`
+}
+
+// A riakRoute holds where and how the messages it matches are stored
+type riakRoute struct {
+	// Nil for the default route, which matches every message
+	matcher     *message.MatcherSpecification
+	index       *template
+	typeName    *template
+	id          *template
+	format      string
+	formatter   MessageFormatter
+	keyStrategy string
+	links       []*linkTemplate
+	// 0 for the TTL of the message severity
+	ttl time.Duration
+	// Query parameters of the writes
+	options url.Values
+}
+
+// Creates the default route out of the output configuration
+func newDefaultRoute(conf *RiakOutputConfig) (r *riakRoute, err error) {
+	r = &riakRoute{
+		format:      conf.Format,
+		keyStrategy: conf.KeyStrategy,
+		options:     writeOptions(conf.W, conf.DW, conf.PW),
+	}
+	if err = validKeyStrategy(conf.KeyStrategy); err != nil {
+		return nil, err
+	}
+	if r.index, err = compileTemplate(conf.Index); err != nil {
+		return nil, err
+	}
+	if r.typeName, err = compileTemplate(conf.TypeName); err != nil {
+		return nil, err
+	}
+	if r.id, err = compileTemplate(conf.Id); err != nil {
+		return nil, err
+	}
+	if r.links, err = compileLinks(conf); err != nil {
+		return nil, err
+	}
+	if r.formatter, err = newMessageFormatter(conf); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Creates a route, using the output configuration for unset settings
+func newRoute(conf *RiakOutputConfig, routeConf RouteConfig) (r *riakRoute, err error) {
+	merged := *conf
+	for _, setting := range []struct {
+		value  string
+		target *string
+	}{
+		{routeConf.Index, &merged.Index},
+		{routeConf.TypeName, &merged.TypeName},
+		{routeConf.Id, &merged.Id},
+		{routeConf.KeyStrategy, &merged.KeyStrategy},
+		{routeConf.Format, &merged.Format},
+		{routeConf.W, &merged.W},
+		{routeConf.DW, &merged.DW},
+		{routeConf.PW, &merged.PW},
+	} {
+		if len(setting.value) > 0 {
+			*setting.target = setting.value
+		}
+	}
+	if len(routeConf.Fields) > 0 {
+		merged.Fields = routeConf.Fields
+	}
+	if len(routeConf.Links) > 0 {
+		merged.Links = routeConf.Links
+	}
+	if r, err = newDefaultRoute(&merged); err != nil {
+		return nil, err
+	}
+	if len(routeConf.TTL) > 0 {
+		if r.ttl, err = parseTTL(routeConf.TTL); err != nil {
+			return nil, err
+		}
+	}
+	if r.matcher, err = message.CreateMatcherSpecification(routeConf.MessageMatcher); err != nil {
+		return nil, fmt.Errorf("Invalid message_matcher %s: %s", routeConf.MessageMatcher, err)
+	}
+	return
+}
+
+// Whether the route applies to the message
+func (r *riakRoute) Match(m *message.Message) bool {
+	return r.matcher == nil || r.matcher.Match(m)
+}
+
+func writeOptions(w string, dw string, pw string) url.Values {
+	options := url.Values{}
+	for name, value := range map[string]string{"w": w, "dw": dw, "pw": pw} {
+		if len(value) > 0 {
+			options.Set(name, value)
+		}
+	}
+	return options
+}
@@ -0,0 +1,76 @@
+package riak
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// A nameSanitizer makes interpolated bucket types, buckets and keys safe to
+// use: characters outside of the allowed ones are replaced, and names longer
+// than the maximum length are truncated. Names are also URL encoded when
+// they are written, see RiakObject.Path.
+type nameSanitizer struct {
+	// Matches runs of characters which aren't allowed, nil if all are
+	invalid     *regexp.Regexp
+	replacement string
+	// Maximum length in bytes, 0 for none
+	maxLength int
+}
+
+// Length of the hash suffix of truncated names
+const truncatedHashLength = 8
+
+// Creates a sanitizer. allowedChars is the body of a regular expression
+// character class, like "A-Za-z0-9_.-", or empty to allow any character.
+func newNameSanitizer(allowedChars string, replacement string, maxLength int) (s *nameSanitizer, err error) {
+	s = &nameSanitizer{replacement: replacement, maxLength: maxLength}
+	if len(allowedChars) > 0 {
+		if s.invalid, err = regexp.Compile("[^" + allowedChars + "]+"); err != nil {
+			return nil, fmt.Errorf("Invalid allowed characters %s: %s", allowedChars, err)
+		}
+	}
+	if maxLength < 0 {
+		return nil, fmt.Errorf("Invalid maximum name length: %d", maxLength)
+	}
+	return
+}
+
+// Returns the sanitized name. Truncated names end with a hash of the full
+// name, so that long names sharing a prefix don't collide.
+func (s *nameSanitizer) Sanitize(name string) string {
+	if !utf8.ValidString(name) {
+		name = string([]rune(name))
+	}
+	if s.invalid != nil {
+		name = s.invalid.ReplaceAllString(name, s.replacement)
+	}
+	if s.maxLength == 0 || len(name) <= s.maxLength {
+		return name
+	}
+	suffix := ""
+	if s.maxLength > 2*truncatedHashLength {
+		sum := sha256.Sum256([]byte(name))
+		suffix = "-" + hex.EncodeToString(sum[:])[:truncatedHashLength]
+	}
+	prefix := name[:s.maxLength-len(suffix)]
+	// Don't cut a multi-byte character in half
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
+
+// Sanitizes the bucket type, bucket and key of an object. Fails if the
+// bucket ends up empty.
+func (s *nameSanitizer) SanitizeObject(obj *RiakObject) error {
+	obj.BucketType = s.Sanitize(obj.BucketType)
+	obj.Bucket = s.Sanitize(obj.Bucket)
+	obj.Key = s.Sanitize(obj.Key)
+	if len(obj.Bucket) == 0 {
+		return fmt.Errorf("Bucket name is empty")
+	}
+	return nil
+}
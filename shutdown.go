@@ -0,0 +1,132 @@
+package riak
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A batchTracker holds the batches handed over to the dispatcher or the
+// committers until they are written, so that the ones left when the
+// shutdown timeout expires can be saved. A nil tracker tracks nothing.
+type batchTracker struct {
+	lock sync.Mutex
+	// By first object, which no other batch holds
+	batches map[*RiakObject][]*RiakObject
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{batches: make(map[*RiakObject][]*RiakObject)}
+}
+
+func (t *batchTracker) Hold(batch []*RiakObject) {
+	if t == nil || len(batch) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.batches[batch[0]] = batch
+}
+
+func (t *batchTracker) Release(batch []*RiakObject) {
+	if t == nil || len(batch) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.batches, batch[0])
+}
+
+// Returns the batches held
+func (t *batchTracker) Batches() (batches [][]*RiakObject) {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, batch := range t.batches {
+		batches = append(batches, batch)
+	}
+	return
+}
+
+// Saves the batches which weren't written by the shutdown timeout to the
+// spool, or else to the dead letter file, returning a summary of them if
+// any. Batches still being written may end up written twice.
+func (o *RiakOutput) abandon() error {
+	batches := o.tracker.Batches()
+	if o.overflow != nil {
+		batches = append(batches, o.overflow.Drain()...)
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+	count, size := 0, 0
+	buckets := make(map[string]int)
+	for _, batch := range batches {
+		count += len(batch)
+		size += batchSize(batch)
+		for _, obj := range batch {
+			buckets[obj.Bucket]++
+		}
+	}
+	var err error
+	destination := "lost"
+	switch {
+	case o.overflow != nil && o.overflow.spool != nil:
+		destination = "spooled to " + o.overflow.spool.dir
+		for _, batch := range batches {
+			if err = o.overflow.spool.Push(batch); err != nil {
+				break
+			}
+			o.countSpooled(batch)
+		}
+	case len(o.deadLetterFile) > 0:
+		destination = "written to " + o.deadLetterFile
+		err = writeDeadLetterFile(o.deadLetterFile, batches)
+	}
+	if err != nil || destination == "lost" {
+		if err != nil {
+			destination = fmt.Sprintf("lost (%s)", err)
+		}
+		atomic.AddInt64(&o.stats.dropped, int64(count))
+	}
+	return fmt.Errorf("Shutdown timeout: %d messages (%d bytes) not written, by bucket: %s; %s",
+		count, size, bucketSummary(buckets), destination)
+}
+
+// Formats counts by bucket, sorted by bucket
+func bucketSummary(buckets map[string]int) string {
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s=%d", name, buckets[name])
+	}
+	return strings.Join(counts, ", ")
+}
+
+// Appends the objects of the batches to the file, one JSON object per line
+func writeDeadLetterFile(path string, batches [][]*RiakObject) (err error) {
+	var file *os.File
+	if file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return fmt.Errorf("Unable to open dead letter file %s: %s", path, err)
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, batch := range batches {
+		for _, obj := range batch {
+			if err = encoder.Encode(obj); err != nil {
+				return fmt.Errorf("Unable to write dead letter file %s: %s", path, err)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package riak
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Policies of the objects larger than max_object_size
+const (
+	// Truncate the payload of the message, appending a marker
+	sizeTruncate = "truncate"
+	// Split the value in chunks, the object linking to the other ones
+	sizeSplit = "split"
+	// Store the message in the dead letter bucket
+	sizeDeadLetter = "dead_letter"
+	// Drop the message
+	sizeDrop = "drop"
+)
+
+// User metadata of split and truncated objects
+const (
+	metaChunks    = "chunks"
+	metaChunk     = "chunk"
+	metaChunkOf   = "chunk-of"
+	metaTruncated = "truncated"
+)
+
+// Riak tag of the links to the chunks of a split object
+const chunkTag = "chunk"
+
+// Appended to truncated payloads, with the number of bytes cut
+const truncationMarker = "... [truncated %d bytes]"
+
+// Attempts to truncate the payload enough, each cutting more
+const maxTruncations = 8
+
+func validSizePolicy(policy string, deadLetterBucket string) error {
+	switch policy {
+	case sizeTruncate, sizeSplit, sizeDrop:
+		return nil
+	case sizeDeadLetter:
+		if len(deadLetterBucket) == 0 {
+			return fmt.Errorf("max_object_policy dead_letter requires a dead_letter_bucket")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported max_object_policy: %s", policy)
+}
+
+// Applies the max_object_policy to the object of the message, which is
+// larger than max_object_size. Returns no object when it's dropped, and an
+// error when it should be dead lettered.
+func (o *RiakOutput) oversized(msg *message.Message, obj *RiakObject) (*RiakObject, error) {
+	atomic.AddInt64(&o.stats.oversized, 1)
+	switch o.sizePolicy {
+	case sizeDrop:
+		atomic.AddInt64(&o.stats.dropped, 1)
+		return nil, nil
+	case sizeTruncate:
+		return o.truncate(msg, len(obj.Value))
+	case sizeSplit:
+		return o.split(msg, obj), nil
+	}
+	return nil, fmt.Errorf("Object of %d bytes is larger than max_object_size %d", len(obj.Value), o.maxObjectSize)
+}
+
+// Builds the object of the message with its payload truncated enough for
+// the object to fit
+func (o *RiakOutput) truncate(msg *message.Message, size int) (obj *RiakObject, err error) {
+	payload := msg.GetPayload()
+	keep := len(payload)
+	// The marker takes room too
+	size += len(fmt.Sprintf(truncationMarker, len(payload)))
+	for i := 0; i < maxTruncations && keep > 0; i++ {
+		// Escaping and compression make the size of the value not
+		// proportional to the payload: cut at least the excess, more each time
+		if keep -= (size - o.maxObjectSize) * (i + 1); keep < 0 {
+			keep = 0
+		}
+		// Don't cut a multi-byte character in half
+		for keep > 0 && !utf8.RuneStart(payload[keep]) {
+			keep--
+		}
+		truncated := msg.Copy()
+		truncated.SetPayload(payload[:keep] + fmt.Sprintf(truncationMarker, len(payload)-keep))
+		if obj, err = o.formatObject(truncated); err != nil {
+			return nil, err
+		}
+		if size = len(obj.Value); size <= o.maxObjectSize {
+			obj.SetMeta(metaTruncated, strconv.Itoa(len(payload)-keep))
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("Object of %d bytes can't be truncated to max_object_size %d", size, o.maxObjectSize)
+}
+
+// Splits the value of the object in chunks of max_object_size. The object
+// keeps the first chunk and the number of chunks, the other ones being
+// stored at its key followed by their index, which hold their index in their
+// user metadata. Chunks are in the bucket type of the object, which only
+// links to them in the default bucket type, where Riak keeps links. The
+// concatenation of the chunks is the value the object would have had.
+func (o *RiakOutput) split(msg *message.Message, obj *RiakObject) *RiakObject {
+	if len(obj.Key) == 0 {
+		// Chunks are found by the key
+		obj.Key = msg.GetUuidString()
+	}
+	linked := linkableType(obj.BucketType)
+	value := obj.Value
+	count := (len(value) + o.maxObjectSize - 1) / o.maxObjectSize
+	obj.Value = value[:o.maxObjectSize]
+	obj.SetMeta(metaChunks, strconv.Itoa(count))
+	for i := 1; i < count; i++ {
+		end := (i + 1) * o.maxObjectSize
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk := &RiakObject{
+			BucketType:  obj.BucketType,
+			Bucket:      obj.Bucket,
+			Key:         obj.Key + "." + strconv.Itoa(i),
+			ContentType: "application/octet-stream",
+			Value:       value[i*o.maxObjectSize : end],
+			Options:     obj.Options,
+			IfNoneMatch: obj.IfNoneMatch,
+			Severity:    obj.Severity,
+		}
+		chunk.SetMeta(metaChunk, strconv.Itoa(i))
+		chunk.SetMeta(metaChunkOf, obj.Key)
+		if linked {
+			obj.Links = append(obj.Links, RiakLink{Bucket: chunk.Bucket, Key: chunk.Key, Tag: chunkTag})
+		}
+		obj.chunks = append(obj.chunks, chunk)
+	}
+	return obj
+}
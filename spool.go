@@ -0,0 +1,115 @@
+package riak
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const spoolSuffix = ".batch"
+
+// A spool keeps batches on disk, one file per batch, until they can be
+// written. Batches are read back in the order they were spooled, including
+// the ones left by a previous run.
+type spool struct {
+	lock sync.Mutex
+	dir  string
+	// Sequence numbers of the spooled batches, oldest first
+	files []uint64
+	next  uint64
+}
+
+func newSpool(dir string) (s *spool, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create spool directory %s: %s", dir, err)
+	}
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		return nil, fmt.Errorf("Unable to read spool directory %s: %s", dir, err)
+	}
+	s = &spool{dir: dir}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, seq)
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Sort(uint64s(s.files))
+	return
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// Number of spooled batches
+func (s *spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.files)
+}
+
+// Appends a batch to the spool
+func (s *spool) Push(objects []*RiakObject) error {
+	data, err := json.Marshal(objects)
+	if err != nil {
+		return fmt.Errorf("Unable to encode spooled batch: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := s.path(s.next)
+	// Written aside then renamed, so that a crash doesn't leave half a batch
+	if err = ioutil.WriteFile(path+".tmp", data, 0600); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to spool batch: %s", err)
+	}
+	s.files = append(s.files, s.next)
+	s.next++
+	return nil
+}
+
+// Removes and returns the oldest batch, nil if there is none. A batch which
+// can't be read is removed along with the error.
+func (s *spool) Pop() (objects []*RiakObject, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.files) == 0 {
+		return nil, nil
+	}
+	path := s.path(s.files[0])
+	s.files = s.files[1:]
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err == nil {
+		err = json.Unmarshal(data, &objects)
+	}
+	os.Remove(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spooled batch %s: %s", path, err)
+	}
+	for _, obj := range objects {
+		obj.spooled = true
+	}
+	return
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,216 @@
+package riak
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type of the messages injected with the output stats
+const statsMessageType = "heka.riak-output.stats"
+
+// Counters of the output, updated atomically by the receiver, the
+// dispatcher and the committers
+type riakStats struct {
+	// Messages read from the input channel
+	received int64
+	// Messages formatted into objects
+	formatted int64
+	// Objects stored, or failed to be
+	written int64
+	failed  int64
+	// Stores retried on another node
+	retried int64
+	// Messages lost without a write attempt: shed on overflow, or while the
+	// breaker of the cluster is open
+	dropped int64
+	spooled int64
+	// Messages whose object was larger than max_object_size
+	oversized int64
+	// Batches being written
+	inFlight  int64
+	lastError atomic.Value
+}
+
+// Counters of a node of the cluster, shared by the committers
+type nodeStats struct {
+	name   string
+	writes int64
+	errors int64
+	// Total time of the writes, in nanoseconds
+	latency int64
+}
+
+// Records a write to the node
+func (n *nodeStats) observe(latency time.Duration, failed bool) {
+	atomic.AddInt64(&n.writes, 1)
+	atomic.AddInt64(&n.latency, int64(latency))
+	if failed {
+		atomic.AddInt64(&n.errors, 1)
+	}
+}
+
+// Average write latency of the node
+func (n *nodeStats) averageLatency() time.Duration {
+	writes := atomic.LoadInt64(&n.writes)
+	if writes == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&n.latency) / writes)
+}
+
+// Logs an error and keeps it as the last one
+func (o *RiakOutput) logError(or pipeline.OutputRunner, err error) {
+	o.stats.lastError.Store(err.Error())
+	or.LogError(err)
+}
+
+// Reports the counters of the output, the write latency of each node and
+// the hits of each transform rule
+func (o *RiakOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ReceivedMessageCount", atomic.LoadInt64(&o.stats.received), "count")
+	message.NewInt64Field(msg, "FormattedMessageCount", atomic.LoadInt64(&o.stats.formatted), "count")
+	message.NewInt64Field(msg, "WrittenMessageCount", atomic.LoadInt64(&o.stats.written), "count")
+	message.NewInt64Field(msg, "FailedMessageCount", atomic.LoadInt64(&o.stats.failed), "count")
+	message.NewInt64Field(msg, "RetriedWriteCount", atomic.LoadInt64(&o.stats.retried), "count")
+	message.NewInt64Field(msg, "DroppedMessageCount", atomic.LoadInt64(&o.stats.dropped), "count")
+	message.NewInt64Field(msg, "SpooledMessageCount", atomic.LoadInt64(&o.stats.spooled), "count")
+	message.NewInt64Field(msg, "OversizedMessageCount", atomic.LoadInt64(&o.stats.oversized), "count")
+	message.NewInt64Field(msg, "BatchesInFlight", atomic.LoadInt64(&o.stats.inFlight), "count")
+	lastError, _ := o.stats.lastError.Load().(string)
+	message.NewStringField(msg, "LastError", lastError)
+	for _, node := range o.nodeStats {
+		message.NewInt64Field(msg, node.name+"-AverageLatency",
+			int64(node.averageLatency()/time.Microsecond), "us")
+	}
+	if o.transformer != nil {
+		for _, rule := range o.transformer.rules {
+			message.NewInt64Field(msg, rule.name+"-HitCount", rule.Hits(), "count")
+		}
+	}
+	return nil
+}
+
+// Maximum number of samples kept between stats messages
+const maxSamples = 10000
+
+// A sampleWindow keeps the most recent samples of a value, from which
+// percentiles are computed at each stats message, and counts all of them
+type sampleWindow struct {
+	lock    sync.Mutex
+	samples []int64
+	// Next sample replaced once full
+	next int
+	// Samples added, including the replaced ones
+	count int64
+}
+
+func (w *sampleWindow) Add(sample int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.count++
+	if len(w.samples) < maxSamples {
+		w.samples = append(w.samples, sample)
+		return
+	}
+	w.samples[w.next] = sample
+	w.next = (w.next + 1) % maxSamples
+}
+
+// Returns the sorted samples and the number of samples added, and starts a
+// new window
+func (w *sampleWindow) Reset() (samples []int64, count int64) {
+	w.lock.Lock()
+	samples, count, w.samples, w.next, w.count = w.samples, w.count, nil, 0, 0
+	w.lock.Unlock()
+	sort.Sort(int64s(samples))
+	return
+}
+
+// Returns the nearest rank percentile of sorted samples, 0 without any
+func percentile(samples []int64, p int) int64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	rank := (p*len(samples) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return samples[rank-1]
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Fills the stats message with the store request latency and batch size
+// percentiles since the last one, and the errors of each node. A store
+// request writes one object to one node, so a batch takes several, and
+// retries take more.
+func (o *RiakOutput) statsMessage(msg *message.Message) {
+	msg.SetType(statsMessageType)
+	msg.SetLogger(o.pluginName)
+	msg.SetHostname(o.hostname)
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetSeverity(6)
+
+	latencies, stores := o.latencies.Reset()
+	batchSizes, batches := o.batchSizes.Reset()
+	for _, p := range []int{50, 95, 99} {
+		message.NewInt64Field(msg, fmt.Sprintf("StoreLatencyP%d", p),
+			percentile(latencies, p)/int64(time.Microsecond), "us")
+	}
+	message.NewInt64Field(msg, "StoreCount", stores, "count")
+	for _, p := range []int{50, 95, 99, 100} {
+		message.NewInt64Field(msg, fmt.Sprintf("BatchSizeP%d", p), percentile(batchSizes, p), "count")
+	}
+	message.NewInt64Field(msg, "BatchCount", batches, "count")
+	for _, node := range o.nodeStats {
+		message.NewInt64Field(msg, node.name+"-Errors", atomic.LoadInt64(&node.errors), "count")
+	}
+}
+
+// Runs in a separate goroutine, injecting a stats message at every interval
+// until stopped
+func (o *RiakOutput) statsReporter(or pipeline.OutputRunner, h pipeline.PluginHelper, stop chan struct{}) {
+	// Packs are taken from the pool ahead of time, as taking one blocks
+	// while the pool is empty: under backpressure or at shutdown, a stats
+	// message is skipped, and the next one covers both intervals.
+	packs := make(chan *pipeline.PipelinePack, 1)
+	go func() {
+		for {
+			pack := h.PipelinePack(0)
+			select {
+			case packs <- pack:
+			case <-stop:
+				pack.Recycle()
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(o.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case pack := <-packs:
+				o.statsMessage(pack.Message)
+				if !or.Inject(pack) {
+					o.logError(or, fmt.Errorf("Unable to inject %s message", statsMessageType))
+				}
+			default:
+			}
+		case <-stop:
+			return
+		}
+	}
+}
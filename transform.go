@@ -0,0 +1,188 @@
+package riak
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// ConfigStruct of a transform rule, applied to messages before they are
+// formatted
+type TransformConfig struct {
+	// Name of the rule in the reports, followed by "-HitCount" (default
+	// "transforms[N]", N being its index)
+	Name string
+	// Names of the dynamic string and bytes fields the rule applies to, as
+	// glob patterns or regular expressions prefixed with "re:". Bytes fields
+	// are transformed as strings and stay bytes fields.
+	Fields []string
+	// Whether the rule applies to the payload
+	Payload bool
+	// "redact" (replace with Replacement), "hmac" (replace with the hex
+	// encoded HMAC-SHA256 keyed with Salt) or "truncate" (keep the first
+	// Length characters, or bytes of values which aren't valid UTF-8)
+	Action string
+	// Regular expression selecting the parts of values to transform (default
+	// the whole value)
+	Pattern string
+	// Replacement of redacted values (default "[REDACTED]")
+	Replacement string
+	// HMAC key
+	Salt string
+	// Number of characters kept by truncate
+	Length int
+}
+
+// A transformRule rewrites string and bytes values of a message
+type transformRule struct {
+	name    string
+	fields  []*regexp.Regexp
+	payload bool
+	pattern *regexp.Regexp
+	// Transforms a value, or the parts of it matched by pattern
+	transform func(string) string
+	// Number of values transformed
+	hits int64
+}
+
+func newTransformRule(conf TransformConfig) (rule *transformRule, err error) {
+	rule = &transformRule{name: conf.Name, payload: conf.Payload}
+	if rule.fields, err = compilePatterns(conf.Fields); err != nil {
+		return nil, err
+	}
+	if len(conf.Pattern) > 0 {
+		if rule.pattern, err = regexp.Compile(conf.Pattern); err != nil {
+			return nil, fmt.Errorf("Invalid transform pattern %s: %s", conf.Pattern, err)
+		}
+	}
+	switch strings.ToLower(conf.Action) {
+	case "redact":
+		replacement := conf.Replacement
+		if len(replacement) == 0 {
+			replacement = "[REDACTED]"
+		}
+		rule.transform = func(string) string {
+			return replacement
+		}
+	case "hmac":
+		if len(conf.Salt) == 0 {
+			return nil, fmt.Errorf("hmac transform requires a salt")
+		}
+		salt := []byte(conf.Salt)
+		rule.transform = func(value string) string {
+			mac := hmac.New(sha256.New, salt)
+			mac.Write([]byte(value))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+	case "truncate":
+		if conf.Length < 0 {
+			return nil, fmt.Errorf("Invalid truncate length: %d", conf.Length)
+		}
+		rule.transform = func(value string) string {
+			if !utf8.ValidString(value) {
+				if len(value) > conf.Length {
+					return value[:conf.Length]
+				}
+				return value
+			}
+			if runes := []rune(value); len(runes) > conf.Length {
+				return string(runes[:conf.Length])
+			}
+			return value
+		}
+	default:
+		return nil, fmt.Errorf("Unknown transform action: %s", conf.Action)
+	}
+	return
+}
+
+// Returns the transformed value and whether it changed
+func (r *transformRule) apply(value string) (string, bool) {
+	var transformed string
+	if r.pattern != nil {
+		transformed = r.pattern.ReplaceAllStringFunc(value, r.transform)
+	} else {
+		transformed = r.transform(value)
+	}
+	if transformed == value {
+		return value, false
+	}
+	atomic.AddInt64(&r.hits, 1)
+	return transformed, true
+}
+
+// Number of values transformed by the rule
+func (r *transformRule) Hits() int64 {
+	return atomic.LoadInt64(&r.hits)
+}
+
+// A messageTransformer applies transform rules in order to messages
+type messageTransformer struct {
+	rules []*transformRule
+}
+
+func newMessageTransformer(confs []TransformConfig) (t *messageTransformer, err error) {
+	t = new(messageTransformer)
+	for i, conf := range confs {
+		rule, err := newTransformRule(conf)
+		if err != nil {
+			return nil, fmt.Errorf("transforms[%d]: %s", i, err)
+		}
+		if len(rule.name) == 0 {
+			rule.name = fmt.Sprintf("transforms[%d]", i)
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return
+}
+
+// Returns the transformed message. The message is copied before its first
+// change, as it may be shared with other outputs.
+func (t *messageTransformer) Transform(m *message.Message) *message.Message {
+	copied := false
+	for _, rule := range t.rules {
+		if rule.payload {
+			if payload, changed := rule.apply(m.GetPayload()); changed {
+				if !copied {
+					m, copied = m.Copy(), true
+				}
+				m.SetPayload(payload)
+			}
+		}
+		if len(rule.fields) == 0 {
+			continue
+		}
+		for i, field := range m.Fields {
+			if !matchAny(rule.fields, field.GetName()) {
+				continue
+			}
+			switch field.GetValueType() {
+			case message.Field_STRING:
+				for j, value := range field.GetValueString() {
+					if transformed, changed := rule.apply(value); changed {
+						if !copied {
+							m, copied = m.Copy(), true
+						}
+						m.Fields[i].ValueString[j] = transformed
+					}
+				}
+			case message.Field_BYTES:
+				for j, value := range field.GetValueBytes() {
+					if transformed, changed := rule.apply(string(value)); changed {
+						if !copied {
+							m, copied = m.Copy(), true
+						}
+						m.Fields[i].ValueBytes[j] = []byte(transformed)
+					}
+				}
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,120 @@
+package riak
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User metadata of objects with a TTL
+const (
+	metaTTL     = "ttl"
+	metaExpires = "expires"
+)
+
+var severityNames = map[string]int32{
+	"emergency": 0,
+	"alert":     1,
+	"critical":  2,
+	"error":     3,
+	"warning":   4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+}
+
+// A ttlPolicy picks how long objects are kept. The TTL of an object is the
+// one of its route if set, else the one of its message severity, else the
+// default one. Objects with a TTL are written to the bucket type mapped to
+// it, so that a multi-backend cluster stores them in a backend expiring
+// them: Riak backends don't expire single objects. Their TTL and expiry are
+// also written in their user metadata, for information only.
+type ttlPolicy struct {
+	def         time.Duration
+	severity    map[int32]time.Duration
+	bucketTypes map[time.Duration]string
+}
+
+// Parses a duration, also accepting a number of days (e.g. "30d")
+func parseTTL(value string) (ttl time.Duration, err error) {
+	if strings.HasSuffix(value, "d") {
+		var days int
+		if days, err = strconv.Atoi(value[:len(value)-1]); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else if ttl, err = time.ParseDuration(value); err == nil && ttl >= 0 {
+		return ttl, nil
+	}
+	return 0, fmt.Errorf("Invalid TTL: %s", value)
+}
+
+func newTTLPolicy(def string, severity map[string]string, bucketTypes map[string]string) (p *ttlPolicy, err error) {
+	p = &ttlPolicy{
+		severity:    make(map[int32]time.Duration),
+		bucketTypes: make(map[time.Duration]string),
+	}
+	for value, bucketType := range bucketTypes {
+		var ttl time.Duration
+		if ttl, err = parseTTL(value); err != nil {
+			return nil, err
+		}
+		p.bucketTypes[ttl] = bucketType
+	}
+	if len(def) > 0 {
+		if p.def, err = parseTTL(def); err != nil {
+			return nil, err
+		}
+		if err = p.Check(p.def, def); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range severity {
+		level, ok := severityNames[strings.ToLower(name)]
+		if !ok {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 0 || n > 7 {
+				return nil, fmt.Errorf("Invalid severity: %s", name)
+			}
+			level = int32(n)
+		}
+		if p.severity[level], err = parseTTL(value); err != nil {
+			return nil, err
+		}
+		if err = p.Check(p.severity[level], value); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Fails if a TTL has no bucket type, as nothing would expire its objects
+func (p *ttlPolicy) Check(ttl time.Duration, value string) error {
+	if _, ok := p.bucketTypes[ttl]; ttl > 0 && !ok {
+		return fmt.Errorf("TTL %s has no bucket type in ttl_bucket_types", value)
+	}
+	return nil
+}
+
+// Returns the TTL of a message of the route, 0 for none
+func (p *ttlPolicy) TTL(r *riakRoute, m *message.Message) time.Duration {
+	if r.ttl > 0 {
+		return r.ttl
+	}
+	if ttl, ok := p.severity[m.GetSeverity()]; ok {
+		return ttl
+	}
+	return p.def
+}
+
+// Applies the TTL of the message to its object
+func (p *ttlPolicy) Apply(obj *RiakObject, r *riakRoute, m *message.Message) {
+	ttl := p.TTL(r, m)
+	if ttl == 0 {
+		return
+	}
+	obj.BucketType = p.bucketTypes[ttl]
+	obj.SetMeta(metaTTL, strconv.FormatInt(int64(ttl/time.Second), 10))
+	obj.SetMeta(metaExpires, messageTime(m).Add(ttl).UTC().Format(time.RFC3339))
+}